@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+)
+
+// aggregateDateFormat is the date format used to detect rotations and name rotated files.
+const aggregateDateFormat = "2006-01-02"
+
+// aggregator appends every paste to a single file, separated by a header for each entry.
+//
+// The file is rotated daily, the previous day's file is renamed to include its date as a suffix
+// (e.g. `pastes.log.2024-01-02`).
+type aggregator struct {
+	path string
+
+	mu sync.Mutex
+	f  *os.File
+	// day is the date of the currently open file, formatted using aggregateDateFormat.
+	day string
+}
+
+// newAggregator returns a new aggregator that appends to the file at path.
+func newAggregator(path string) *aggregator {
+	return &aggregator{path: path}
+}
+
+// Append appends a paste to the aggregate file, rotating the file first if required.
+func (a *aggregator) Append(now time.Time, ip string, content []byte) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.rotate(now); err != nil {
+		return err
+	}
+
+	// Write the entry using a single write, so entries are never interleaved with writes from
+	// another process appending to the same file.
+	header := "---- " + now.Format(time.RFC3339) + " " + ip + " ----\n"
+	entry := make([]byte, 0, len(header)+len(content)+1)
+	entry = append(entry, header...)
+	entry = append(entry, content...)
+	entry = append(entry, '\n')
+	if _, err := a.f.Write(entry); err != nil {
+		return fmt.Errorf("failed to write to aggregate file: %w", err)
+	}
+	return nil
+}
+
+// rotate ensures the aggregate file is open and belongs to the current day.
+//
+// a.mu must be held when calling rotate.
+func (a *aggregator) rotate(now time.Time) error {
+	day := now.Format(aggregateDateFormat)
+	if a.f != nil && a.day == day {
+		return nil
+	}
+
+	if a.f != nil {
+		if err := a.f.Close(); err != nil {
+			return fmt.Errorf("failed to close aggregate file: %w", err)
+		}
+		a.f = nil
+	}
+
+	// If a file already exists from a previous day (either the file we just closed, or one left
+	// behind by a previous run), move it out of the way.
+	if st, err := os.Stat(a.path); err == nil {
+		if prev := st.ModTime().Format(aggregateDateFormat); prev != day {
+			if err := os.Rename(a.path, a.path+"."+prev); err != nil {
+				return fmt.Errorf("failed to rotate aggregate file: %w", err)
+			}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to stat aggregate file: %w", err)
+	}
+
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open aggregate file: %w", err)
+	}
+	a.f = f
+	a.day = day
+	return nil
+}
+
+// Close closes the aggregate file.
+func (a *aggregator) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
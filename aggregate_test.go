@@ -0,0 +1,46 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAggregator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pastes.log")
+	a := newAggregator(path)
+	defer a.Close()
+
+	day1 := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	if err := a.Append(day1, "192.0.2.1", []byte("first")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if err := a.Append(day1.Add(time.Hour), "192.0.2.2", []byte("second\n")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	want := "---- 2024-01-02T10:00:00Z 192.0.2.1 ----\nfirst\n" +
+		"---- 2024-01-02T11:00:00Z 192.0.2.2 ----\nsecond\n\n"
+	if b, err := os.ReadFile(path); err != nil || string(b) != want {
+		t.Errorf("expected %q, got %q (%v)", want, b, err)
+	}
+
+	// The file belongs to the day its last entry was written on.
+	if err := os.Chtimes(path, day1, day1); err != nil {
+		t.Fatalf("failed to set modification time: %v", err)
+	}
+	day2 := day1.Add(24 * time.Hour)
+	if err := a.Append(day2, "192.0.2.3", []byte("third")); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if b, err := os.ReadFile(path + ".2024-01-02"); err != nil || string(b) != want {
+		t.Errorf("expected the rotated file to contain %q, got %q (%v)", want, b, err)
+	}
+	want = "---- 2024-01-03T10:00:00Z 192.0.2.3 ----\nthird\n"
+	if b, err := os.ReadFile(path); err != nil || string(b) != want {
+		t.Errorf("expected %q, got %q (%v)", want, b, err)
+	}
+}
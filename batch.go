@@ -0,0 +1,58 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+)
+
+// splitBatch splits content into documents separated by lines consisting only of delimiter.
+//
+// The delimiter lines themselves are not included in any document, and empty documents (e.g.
+// from a trailing delimiter) are skipped.
+func splitBatch(content []byte, delimiter string) [][]byte {
+	var (
+		docs  [][]byte
+		start int
+	)
+	for offset := 0; offset < len(content); {
+		end := len(content)
+		if i := bytes.IndexByte(content[offset:], '\n'); i >= 0 {
+			end = offset + i + 1
+		}
+		line := bytes.TrimSuffix(bytes.TrimSuffix(content[offset:end], []byte{'\n'}), []byte{'\r'})
+		if string(line) == delimiter {
+			if offset > start {
+				docs = append(docs, content[start:offset])
+			}
+			start = end
+		}
+		offset = end
+	}
+	if start < len(content) {
+		docs = append(docs, content[start:])
+	}
+	return docs
+}
+
+// checkBatch checks the documents of a batch against the batch limits, responding to the client
+// if they are exceeded.
+func checkBatch(conn net.Conn, docs [][]byte) error {
+	if len(docs) < 1 {
+		return respondWithError(conn, ErrRejected, "Batches must contain at least one document\n")
+	}
+	if len(docs) > CLI.BatchMaxDocuments {
+		msg := "Batches may not contain more than " + strconv.Itoa(CLI.BatchMaxDocuments) + " documents\n"
+		return respondWithError(conn, ErrLimitExceeded, msg)
+	}
+	for _, doc := range docs {
+		if len(doc) > CLI.Limit {
+			msg := "Documents may not exceed " + strconv.Itoa(CLI.Limit) + " bytes of data\n"
+			return respondWithError(conn, ErrLimitExceeded, msg)
+		}
+	}
+	return nil
+}
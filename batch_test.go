@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSplitBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    []string
+	}{
+		{
+			name:    "single document",
+			content: "hello\nworld\n",
+			want:    []string{"hello\nworld\n"},
+		},
+		{
+			name:    "two documents",
+			content: "hello\n---\nworld\n",
+			want:    []string{"hello\n", "world\n"},
+		},
+		{
+			name:    "crlf",
+			content: "hello\r\n---\r\nworld\r\n",
+			want:    []string{"hello\r\n", "world\r\n"},
+		},
+		{
+			name:    "delimiter not on its own line",
+			content: "hello ---\n--- world\n",
+			want:    []string{"hello ---\n--- world\n"},
+		},
+		{
+			name:    "empty documents",
+			content: "---\nhello\n---\n---\nworld\n---",
+			want:    []string{"hello\n", "world\n"},
+		},
+		{
+			name:    "only delimiters",
+			content: "---\n---\n",
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, doc := range splitBatch([]byte(tt.content), "---") {
+				got = append(got, string(doc))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHandle_Batch(t *testing.T) {
+	setFlags(t, "--batch-delimiter=---")
+	s, h := newTestServer(t, nil)
+
+	res, err := roundTrip(t, s, "first\n---\nsecond\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if docs := h.documents(); !slices.Equal(docs, []string{"first\n", "second\n"}) {
+		t.Errorf("expected 2 documents, got %q", docs)
+	}
+	if want := s.haste.URL + "/doc1\n" + s.haste.URL + "/doc2\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+}
+
+func TestHandle_BatchLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{
+			name:    "document too large",
+			content: "0123456789\n---\n",
+			want:    "Documents may not exceed 8 bytes of data\n",
+		},
+		{
+			name:    "batch too large",
+			content: "aaaaaa\n---\nbbbbbb\n",
+			want:    "Pastes may not exceed 16 bytes of data",
+		},
+		{
+			name:    "too many documents",
+			content: "a\n---\nb\n---\nc\n",
+			want:    "Batches may not contain more than 2 documents\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, "--batch-delimiter=---", "--batch-max-documents=2", "--limit=8")
+			s, h := newTestServer(t, nil)
+
+			res, err := roundTrip(t, s, tt.content)
+			if !errors.Is(err, ErrLimitExceeded) {
+				t.Errorf("expected ErrLimitExceeded, got %v", err)
+			}
+			if res != tt.want {
+				t.Errorf("expected response %q, got %q", tt.want, res)
+			}
+			if docs := h.documents(); len(docs) > 0 {
+				t.Errorf("expected no documents to be uploaded, got %q", docs)
+			}
+		})
+	}
+}
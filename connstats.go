@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"time"
+)
+
+// maxDiagnosticReads is the number of read sizes kept for a connection's diagnostics.
+const maxDiagnosticReads = 32
+
+// statsConn wraps a net.Conn and counts the reads, writes and deadline resets made on it.
+//
+// A statsConn is only used by the goroutine handling the connection, so the counters aren't
+// synchronized.
+type statsConn struct {
+	net.Conn
+
+	reads          int
+	bytesRead      int
+	writes         int
+	bytesWritten   int
+	deadlineResets int
+
+	// diagnostics enables recording the timings and sizes of reads, see logDiagnostics.
+	diagnostics bool
+	started     time.Time
+	firstByte   time.Time
+	lastRead    time.Time
+	readSizes   []int
+}
+
+// newStatsConn returns a new statsConn wrapping conn.
+func newStatsConn(conn net.Conn, diagnostics bool) *statsConn {
+	return &statsConn{Conn: conn, diagnostics: diagnostics, started: time.Now()}
+}
+
+// Read satisfies the io.Reader interface.
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.reads++
+	c.bytesRead += n
+	if c.diagnostics {
+		c.lastRead = time.Now()
+		if n > 0 && c.firstByte.IsZero() {
+			c.firstByte = c.lastRead
+		}
+		if len(c.readSizes) < maxDiagnosticReads {
+			c.readSizes = append(c.readSizes, n)
+		}
+	}
+	return n, err
+}
+
+// Write satisfies the io.Writer interface.
+func (c *statsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.writes++
+	c.bytesWritten += n
+	return n, err
+}
+
+// SetReadDeadline satisfies the net.Conn interface.
+func (c *statsConn) SetReadDeadline(t time.Time) error {
+	c.deadlineResets++
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline satisfies the net.Conn interface.
+func (c *statsConn) SetWriteDeadline(t time.Time) error {
+	c.deadlineResets++
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// log logs the stats of the connection at debug level, this helps identify pathological clients
+// (e.g. ones sending a paste using many tiny writes).
+func (c *statsConn) log(ctx context.Context) {
+	slog.LogAttrs(
+		ctx,
+		slog.LevelDebug,
+		"connection stats",
+		slog.Int("reads", c.reads),
+		slog.Int("bytes_read", c.bytesRead),
+		slog.Int("writes", c.writes),
+		slog.Int("bytes_written", c.bytesWritten),
+		slog.Int("deadline_resets", c.deadlineResets),
+	)
+}
+
+// logDiagnostics logs everything recorded about the connection at warn level, this is only done
+// for connections ending in an error so successful connections don't flood the logs.
+func (c *statsConn) logDiagnostics(ctx context.Context, err error) {
+	attrs := []slog.Attr{
+		slog.Any("err", err),
+		slog.Duration("duration", time.Since(c.started)),
+		slog.Int("reads", c.reads),
+		slog.Int("bytes_read", c.bytesRead),
+		slog.Int("writes", c.writes),
+		slog.Int("bytes_written", c.bytesWritten),
+		slog.Int("deadline_resets", c.deadlineResets),
+		slog.Any("read_sizes", c.readSizes),
+	}
+	if !c.firstByte.IsZero() {
+		attrs = append(attrs, slog.Duration("first_byte", c.firstByte.Sub(c.started)))
+	}
+	if !c.lastRead.IsZero() {
+		attrs = append(attrs, slog.Duration("last_read", c.lastRead.Sub(c.started)))
+	}
+	slog.LogAttrs(ctx, slog.LevelWarn, "connection diagnostics", attrs...)
+}
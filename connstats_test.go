@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandle_MaxReadsPerConn(t *testing.T) {
+	setFlags(t, "--max-reads-per-conn=2")
+	s, h := newTestServer(t, nil)
+
+	// sendWrites sends each write separately, so they are received using separate reads.
+	sendWrites := func(writes ...string) func(conn *net.TCPConn) error {
+		return func(conn *net.TCPConn) error {
+			for _, w := range writes {
+				if _, err := conn.Write([]byte(w)); err != nil {
+					return err
+				}
+				time.Sleep(50 * time.Millisecond)
+			}
+			return conn.CloseWrite()
+		}
+	}
+
+	t.Run("within limit", func(t *testing.T) {
+		if _, err := roundTripFunc(t, s, sendWrites("hello", "world")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if docs := h.documents(); len(docs) != 1 || docs[0] != "helloworld" {
+			t.Errorf("expected a single document, got %q", docs)
+		}
+	})
+
+	t.Run("over limit", func(t *testing.T) {
+		res, err := roundTripFunc(t, s, sendWrites("a", "b", "c"))
+		if !errors.Is(err, ErrTooManyReads) {
+			t.Errorf("expected ErrTooManyReads, got %v", err)
+		}
+		if want := "Pastes may not be sent using more than 2 reads\n"; res != want {
+			t.Errorf("expected response %q, got %q", want, res)
+		}
+	})
+}
+
+func TestHandle_ConnStats(t *testing.T) {
+	setFlags(t, "--log-format=json", "--log-level=debug")
+	logs := captureLogs(t)
+	s, _ := newTestServer(t, nil)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	conn := &scriptedConn{Conn: server, reads: []readResult{
+		{data: "hel"},
+		{data: "lo "},
+		{data: "world", err: io.EOF},
+	}}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.handle(context.Background(), conn)
+		_ = server.Close()
+	}()
+	_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+	res, _ := io.ReadAll(client)
+	if err := <-errCh; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	type stats struct {
+		Reads          int `json:"reads"`
+		BytesRead      int `json:"bytes_read"`
+		Writes         int `json:"writes"`
+		BytesWritten   int `json:"bytes_written"`
+		DeadlineResets int `json:"deadline_resets"`
+	}
+	var got stats
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if strings.Contains(line, `"msg":"connection stats"`) {
+			_ = json.Unmarshal([]byte(line), &got)
+		}
+	}
+	// A read deadline is set before each read, and a write deadline before the response.
+	want := stats{
+		Reads:          3,
+		BytesRead:      len("hello world"),
+		Writes:         1,
+		BytesWritten:   len(res),
+		DeadlineResets: 4,
+	}
+	if got != want {
+		t.Errorf("expected %+v, got %+v in %q", want, got, logs.String())
+	}
+}
+
+func TestHandle_DiagnosticsOnError(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr error
+	}{
+		{
+			name: "success",
+			data: "hi",
+		},
+		{
+			name:    "failure",
+			data:    "hello world",
+			wantErr: ErrLimitExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, "--log-format=json", "--diagnostics-on-error", "--limit=4")
+			logs := captureLogs(t)
+			s, _ := newTestServer(t, nil)
+
+			if _, err := roundTrip(t, s, tt.data); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("expected %v, got %v", tt.wantErr, err)
+			}
+
+			var (
+				found       bool
+				diagnostics struct {
+					Level     string `json:"level"`
+					Err       string `json:"err"`
+					BytesRead int    `json:"bytes_read"`
+					ReadSizes []int  `json:"read_sizes"`
+				}
+			)
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				if strings.Contains(line, `"msg":"connection diagnostics"`) {
+					found = true
+					_ = json.Unmarshal([]byte(line), &diagnostics)
+				}
+			}
+			if tt.wantErr == nil {
+				if found {
+					t.Errorf("expected no diagnostics for a successful connection, got %q", logs.String())
+				}
+				return
+			}
+			if !found {
+				t.Fatalf("expected diagnostics for a failed connection, got %q", logs.String())
+			}
+			if diagnostics.Level != "WARN" || diagnostics.Err == "" {
+				t.Errorf("expected a warning with the error, got level %q and error %q", diagnostics.Level, diagnostics.Err)
+			}
+			// Nothing past the limit (and the one byte used to detect it) is read.
+			if diagnostics.BytesRead != 5 || len(diagnostics.ReadSizes) < 1 {
+				t.Errorf("expected 5 bytes read and the read sizes, got %d and %v", diagnostics.BytesRead, diagnostics.ReadSizes)
+			}
+		})
+	}
+}
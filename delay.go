@@ -0,0 +1,106 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// requestRateWindow is the window used to count recent requests from an address.
+	requestRateWindow = time.Minute
+	// maxRequestRateEntries is the maximum number of addresses tracked at once.
+	maxRequestRateEntries = 16384
+)
+
+// requestRateEntry is the number of requests from an address in the current window.
+type requestRateEntry struct {
+	count uint64
+	start time.Time
+}
+
+// requestRate counts recent requests per address, used to scale the response delay.
+type requestRate struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]*requestRateEntry
+}
+
+// newRequestRate returns a new, empty requestRate.
+func newRequestRate() *requestRate {
+	return &requestRate{
+		entries: make(map[netip.Addr]*requestRateEntry),
+	}
+}
+
+// Add records a request from addr, returning the number of requests from addr in the current
+// window (including this one).
+func (r *requestRate) Add(addr netip.Addr, now time.Time) uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.entries[addr]
+	if !ok || now.Sub(e.start) >= requestRateWindow {
+		if !ok && len(r.entries) >= maxRequestRateEntries {
+			r.evictExpired(now)
+		}
+		if !ok && len(r.entries) >= maxRequestRateEntries {
+			// Everything is still within the window, start over rather than growing without
+			// bound.
+			clear(r.entries)
+		}
+		e = &requestRateEntry{start: now}
+		r.entries[addr] = e
+	}
+	e.count++
+	return e.count
+}
+
+// evictExpired removes all entries whose window has passed.
+//
+// r.mu must be held when calling evictExpired.
+func (r *requestRate) evictExpired(now time.Time) {
+	for addr, e := range r.entries {
+		if now.Sub(e.start) >= requestRateWindow {
+			delete(r.entries, addr)
+		}
+	}
+}
+
+// responseDelay returns how long to wait before responding to the client at remoteAddr.
+func (s *Server) responseDelay(remoteAddr string) time.Duration {
+	if CLI.ResponseDelay <= 0 {
+		return 0
+	}
+	if !CLI.ResponseDelayScale {
+		return CLI.ResponseDelay
+	}
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return CLI.ResponseDelay
+	}
+	count := s.requestRate.Add(addrPort.Addr().Unmap(), time.Now())
+
+	// Check against the maximum before multiplying, so a large count can't overflow.
+	maxDelay := max(CLI.ResponseDelayMax, CLI.ResponseDelay)
+	if count >= uint64(maxDelay/CLI.ResponseDelay) {
+		return maxDelay
+	}
+	return CLI.ResponseDelay * time.Duration(count)
+}
+
+// sleep waits for d or until the context is canceled.
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
@@ -0,0 +1,90 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHandle_ResponseDelay(t *testing.T) {
+	setFlags(t, "--response-delay=200ms")
+	s, _ := newTestServer(t, nil)
+
+	start := time.Now()
+	res, err := roundTrip(t, s, "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected the response to be delayed by at least 200ms, got %s", elapsed)
+	}
+	if want := s.haste.URL + "/doc1\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+}
+
+func TestResponseDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		addr   string
+		delays []time.Duration
+	}{
+		{
+			name:   "disabled",
+			addr:   "192.0.2.1:1234",
+			delays: []time.Duration{0, 0},
+		},
+		{
+			name:   "fixed",
+			args:   []string{"--response-delay=1s"},
+			addr:   "192.0.2.1:1234",
+			delays: []time.Duration{time.Second, time.Second},
+		},
+		{
+			name:   "scaled",
+			args:   []string{"--response-delay=1s", "--response-delay-scale", "--response-delay-max=3s"},
+			addr:   "192.0.2.1:1234",
+			delays: []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second},
+		},
+		{
+			name:   "scaled without an address",
+			args:   []string{"--response-delay=1s", "--response-delay-scale"},
+			addr:   unknownRemoteAddr,
+			delays: []time.Duration{time.Second, time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			s := NewServer(nil, nil)
+			for i, want := range tt.delays {
+				if got := s.responseDelay(tt.addr); got != want {
+					t.Errorf("expected a delay of %s for request %d, got %s", want, i+1, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestRate(t *testing.T) {
+	r := newRequestRate()
+	addr := netip.MustParseAddr("192.0.2.1")
+	now := time.Now()
+
+	if n := r.Add(addr, now); n != 1 {
+		t.Errorf("expected 1 request, got %d", n)
+	}
+	if n := r.Add(addr, now.Add(time.Second)); n != 2 {
+		t.Errorf("expected 2 requests, got %d", n)
+	}
+	if n := r.Add(netip.MustParseAddr("192.0.2.2"), now); n != 1 {
+		t.Errorf("expected addresses to be counted separately, got %d", n)
+	}
+	if n := r.Add(addr, now.Add(requestRateWindow)); n != 1 {
+		t.Errorf("expected the count to reset after the window, got %d", n)
+	}
+}
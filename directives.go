@@ -0,0 +1,218 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// directivePrefix is the prefix of a line that contains a directive.
+const directivePrefix = '!'
+
+// maxCustomKeyLength is the maximum length of a key requested using the `!key` directive.
+const maxCustomKeyLength = 64
+
+// maxTraceIDLength is the maximum length of a trace ID sent using the `!trace-id` directive.
+const maxTraceIDLength = 64
+
+// maxFilenameLength is the maximum length of a filename sent using the `!filename` directive.
+const maxFilenameLength = 128
+
+// maxFilenameExtLength is the maximum length of a filename's extension that will be used for
+// syntax highlighting.
+const maxFilenameExtLength = 16
+
+var (
+	// errInvalidCustomKey is returned when a client requests an invalid key using `!key`.
+	errInvalidCustomKey = errors.New("invalid custom key")
+	// errInvalidFilename is returned when a client sends an invalid filename using `!filename`.
+	errInvalidFilename = errors.New("invalid filename")
+	// errDirectiveTooLong is returned when a directive line exceeds `CLI.MaxDirectiveLine`.
+	errDirectiveTooLong = errors.New("directive line too long")
+	// errDirectiveValueTooLong is returned when a directive's value exceeds
+	// `CLI.MaxDirectiveValue`.
+	errDirectiveValueTooLong = errors.New("directive value too long")
+)
+
+// directives are options sent by a client on leading lines before the content of a paste.
+//
+// Each directive is sent on its own line in the form of `!name value`.
+type directives struct {
+	// key is the custom key requested using `!key`.
+	key string
+	// filename is the filename of the paste sent using `!filename`.
+	filename string
+	// traceID is the trace ID sent using `!trace-id`, used as the ID of the connection in logs.
+	traceID string
+}
+
+// ext returns the extension of the filename sent using `!filename`, without the leading dot.
+//
+// An empty string is returned if there is no filename, or its extension isn't suitable for use
+// in a URL.
+func (d directives) ext() string {
+	ext := strings.TrimPrefix(path.Ext(d.filename), ".")
+	if len(ext) > maxFilenameExtLength {
+		return ""
+	}
+	for _, c := range []byte(ext) {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		default:
+			return ""
+		}
+	}
+	return strings.ToLower(ext)
+}
+
+// parseDirectives parses any enabled directives from the leading lines of content, returning
+// the content with the directive lines stripped.
+//
+// Parsing stops at the first line that isn't an enabled directive, anything from that line on
+// is treated as content. This includes blank lines, so a paste starting with a blank line keeps
+// it, regardless of whether any directives are enabled.
+func parseDirectives(content []byte) (directives, []byte, error) {
+	var d directives
+	if !CLI.AllowCustomKeys && !CLI.AllowFilename && !CLI.AcceptClientTraceID {
+		return d, content, nil
+	}
+
+	// The paste has already been read into memory (bounded by `--limit`), but only the start of
+	// each line is searched for its end. This way an unterminated directive doesn't mean
+	// searching the rest of the paste for a line ending.
+	maxLine := max(CLI.MaxDirectiveLine, 1)
+	var offset int
+	for n := 0; n < CLI.MaxDirectives; n++ {
+		rest := content[offset:]
+		// A blank line is the start of the content, not an empty directive.
+		if len(rest) < 1 || rest[0] != directivePrefix {
+			break
+		}
+
+		// Allow for the line to be terminated using CRLF (e.g. by clients on Windows or using
+		// telnet), the line ending doesn't count towards the maximum length.
+		window := rest[:min(len(rest), maxLine+2)]
+		i := bytes.IndexByte(window, '\n')
+		if i < 0 {
+			// An unterminated line that fits within the window is the only line of the paste
+			// and must be treated as content.
+			if len(rest) > len(window) && directiveLine(window) {
+				return d, nil, errDirectiveTooLong
+			}
+			break
+		}
+		line := bytes.TrimSuffix(window[:i], []byte{'\r'})
+		if len(line) > maxLine {
+			// Only treat the line as an over-long directive if it is actually a directive,
+			// otherwise it's just a long line of content.
+			if directiveLine(line) {
+				return d, nil, errDirectiveTooLong
+			}
+			break
+		}
+
+		name, value, _ := bytes.Cut(line[1:], []byte{' '})
+		if !directiveEnabled(name) {
+			break
+		}
+		if len(value) > CLI.MaxDirectiveValue {
+			return d, nil, errDirectiveValueTooLong
+		}
+		switch string(name) {
+		case "key":
+			if !validCustomKey(value) {
+				return d, nil, errInvalidCustomKey
+			}
+			d.key = string(value)
+		case "filename":
+			if !validFilename(value) {
+				return d, nil, errInvalidFilename
+			}
+			d.filename = string(value)
+		case "trace-id":
+			// An invalid trace ID isn't worth failing the paste over, the generated ID of the
+			// connection is used instead.
+			if validTraceID(value) {
+				d.traceID = string(value)
+			}
+		}
+		offset += i + 1
+	}
+	return d, content[offset:], nil
+}
+
+// directiveLine returns true if line starts with an enabled directive.
+func directiveLine(line []byte) bool {
+	if len(line) < 1 || line[0] != directivePrefix {
+		return false
+	}
+	name, _, _ := bytes.Cut(line[1:], []byte{' '})
+	return directiveEnabled(name)
+}
+
+// directiveEnabled returns true if the directive with the provided name is enabled.
+func directiveEnabled(name []byte) bool {
+	switch string(name) {
+	case "key":
+		return CLI.AllowCustomKeys
+	case "filename":
+		return CLI.AllowFilename
+	case "trace-id":
+		return CLI.AcceptClientTraceID
+	default:
+		return false
+	}
+}
+
+// validCustomKey returns true if key is an acceptable custom key.
+func validCustomKey(key []byte) bool {
+	if len(key) < 1 || len(key) > maxCustomKeyLength {
+		return false
+	}
+	for _, c := range key {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validFilename returns true if name is an acceptable filename.
+//
+// Filenames must be a single path element, so they can't contain any path separators.
+func validFilename(name []byte) bool {
+	if len(name) < 1 || len(name) > maxFilenameLength || !utf8.Valid(name) {
+		return false
+	}
+	if string(name) == "." || string(name) == ".." {
+		return false
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f || c == '/' || c == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// validTraceID returns true if id is an acceptable trace ID.
+func validTraceID(id []byte) bool {
+	if len(id) < 1 || len(id) > maxTraceIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
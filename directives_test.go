@@ -0,0 +1,484 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDirectives_MaxDirectiveLine(t *testing.T) {
+	setFlags(t, "--allow-custom-keys", "--max-directive-line=10")
+
+	tests := []struct {
+		name    string
+		content string
+		key     string
+		rest    string
+		err     error
+	}{
+		{
+			name:    "shorter",
+			content: "!key abc\nhello",
+			key:     "abc",
+			rest:    "hello",
+		},
+		{
+			name:    "exactly the limit",
+			content: "!key abcde\nhello",
+			key:     "abcde",
+			rest:    "hello",
+		},
+		{
+			name:    "exactly the limit with crlf",
+			content: "!key abcde\r\nhello",
+			key:     "abcde",
+			rest:    "hello",
+		},
+		{
+			name:    "over the limit",
+			content: "!key abcdef\nhello",
+			err:     errDirectiveTooLong,
+		},
+		{
+			name:    "unterminated over the limit",
+			content: "!key " + strings.Repeat("a", 100),
+			err:     errDirectiveTooLong,
+		},
+		{
+			name:    "unterminated within the limit",
+			content: "!key abc",
+			rest:    "!key abc",
+		},
+		{
+			name:    "long line of content",
+			content: strings.Repeat("a", 100) + "\nhello",
+			rest:    strings.Repeat("a", 100) + "\nhello",
+		},
+		{
+			name:    "long unknown directive",
+			content: "!unknown " + strings.Repeat("a", 100) + "\nhello",
+			rest:    "!unknown " + strings.Repeat("a", 100) + "\nhello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, rest, err := parseDirectives([]byte(tt.content))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if d.key != tt.key {
+				t.Errorf("expected key %q, got %q", tt.key, d.key)
+			}
+			if string(rest) != tt.rest {
+				t.Errorf("expected content %q, got %q", tt.rest, rest)
+			}
+		})
+	}
+}
+
+func TestHandle_CustomKey(t *testing.T) {
+	setFlags(t, "--allow-custom-keys")
+	s, h := newTestServer(t, nil)
+
+	res, err := roundTrip(t, s, "!key my-key_1\nhello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := s.haste.URL + "/my-key_1\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+	if docs := h.documents(); len(docs) != 1 || docs[0] != "hello" {
+		t.Errorf("expected the directive to be stripped, got %q", docs)
+	}
+
+	res, err = roundTrip(t, s, "!key my-key_1\nagain")
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected ErrRejected, got %v", err)
+	}
+	if want := "The key \"my-key_1\" is already taken\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+
+	for _, key := range []string{"", "../etc", "a b", strings.Repeat("a", maxCustomKeyLength+1)} {
+		res, err = roundTrip(t, s, "!key "+key+"\nhello")
+		if !errors.Is(err, ErrInvalidDirective) {
+			t.Errorf("expected ErrInvalidDirective for %q, got %v", key, err)
+		}
+		if !strings.HasPrefix(res, "Custom keys may only contain") {
+			t.Errorf("unexpected response for %q: %q", key, res)
+		}
+	}
+	if docs := h.documents(); len(docs) != 1 {
+		t.Errorf("expected only the first document to be uploaded, got %q", docs)
+	}
+}
+
+func TestParseDirectives_Disabled(t *testing.T) {
+	setFlags(t)
+	d, rest, err := parseDirectives([]byte("!key abc\nhello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.key != "" || string(rest) != "!key abc\nhello" {
+		t.Errorf("expected directives to be ignored, got key %q and content %q", d.key, rest)
+	}
+}
+
+func TestHandle_DirectiveSplitAcrossReads(t *testing.T) {
+	setFlags(t, "--allow-custom-keys")
+	s, h := newTestServer(t, nil)
+
+	res, err := roundTripFunc(t, s, func(conn *net.TCPConn) error {
+		for _, w := range []string{"!ke", "y abc", "\nhello"} {
+			if _, err := conn.Write([]byte(w)); err != nil {
+				return err
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return conn.CloseWrite()
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := s.haste.URL + "/abc\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+	if docs := h.documents(); len(docs) != 1 || docs[0] != "hello" {
+		t.Errorf("expected the directive to be stripped, got %q", docs)
+	}
+}
+
+func TestParseDirectives_Filename(t *testing.T) {
+	setFlags(t, "--allow-filename")
+	tests := []struct {
+		name     string
+		filename string
+		valid    bool
+		ext      string
+	}{
+		{name: "simple", filename: "app.log", valid: true, ext: "log"},
+		{name: "multiple extensions", filename: "backup.tar.gz", valid: true, ext: "gz"},
+		{name: "no extension", filename: "README", valid: true},
+		{name: "upper case extension", filename: "main.GO", valid: true, ext: "go"},
+		{name: "spaces", filename: "my notes.md", valid: true, ext: "md"},
+		{name: "unicode", filename: "café.txt", valid: true, ext: "txt"},
+		{name: "unsafe extension", filename: "a.c++", valid: true},
+		{name: "long extension", filename: "a." + strings.Repeat("x", maxFilenameExtLength+1), valid: true},
+		{name: "max length", filename: strings.Repeat("a", maxFilenameLength), valid: true},
+		{name: "too long", filename: strings.Repeat("a", maxFilenameLength+1)},
+		{name: "path traversal", filename: "../../etc/passwd"},
+		{name: "path", filename: "logs/app.log"},
+		{name: "windows path", filename: `C:\Windows\app.log`},
+		{name: "dot", filename: "."},
+		{name: "dot dot", filename: ".."},
+		{name: "null byte", filename: "app.log\x00.txt"},
+		{name: "escape sequence", filename: "\x1b[31mapp.log"},
+		{name: "invalid utf-8", filename: "app\xff.log"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, rest, err := parseDirectives([]byte("!filename " + tt.filename + "\nhello"))
+			if !tt.valid {
+				if !errors.Is(err, errInvalidFilename) {
+					t.Errorf("expected errInvalidFilename, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if d.filename != tt.filename || string(rest) != "hello" {
+				t.Errorf("expected filename %q and content %q, got %q and %q", tt.filename, "hello", d.filename, rest)
+			}
+			if got := d.ext(); got != tt.ext {
+				t.Errorf("expected extension %q, got %q", tt.ext, got)
+			}
+		})
+	}
+}
+
+func TestHandle_Filename(t *testing.T) {
+	setFlags(t, "--allow-filename", "--auto-extension")
+	s, h := newTestServer(t, nil)
+
+	// The filename's extension takes precedence over the detected one.
+	res, err := roundTrip(t, s, "!filename main.py\npackage main\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := s.haste.URL + "/doc1.py\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+	if docs := h.documents(); !slices.Equal(docs, []string{"package main\n"}) {
+		t.Errorf("expected the directive to be stripped, got %q", docs)
+	}
+
+	res, err = roundTrip(t, s, "!filename ../etc/passwd\nhello")
+	if !errors.Is(err, ErrInvalidDirective) {
+		t.Errorf("expected ErrInvalidDirective, got %v", err)
+	}
+	if !strings.HasPrefix(res, "Filenames must be at most") {
+		t.Errorf("unexpected response %q", res)
+	}
+	if docs := h.documents(); len(docs) != 1 {
+		t.Errorf("expected only the first document to be uploaded, got %q", docs)
+	}
+}
+
+func TestParseDirectives_CRLF(t *testing.T) {
+	setFlags(t, "--allow-custom-keys", "--allow-filename", "--accept-client-trace-id")
+	tests := []struct {
+		name     string
+		content  string
+		key      string
+		filename string
+		traceID  string
+		rest     string
+	}{
+		{
+			name:    "crlf",
+			content: "!key abc\r\nhello\r\n",
+			key:     "abc",
+			rest:    "hello\r\n",
+		},
+		{
+			name:     "multiple",
+			content:  "!filename main.go\r\n!key abc\r\n!trace-id t-1\r\npackage main\r\n",
+			key:      "abc",
+			filename: "main.go",
+			traceID:  "t-1",
+			rest:     "package main\r\n",
+		},
+		{
+			name:     "mixed",
+			content:  "!filename main.go\n!key abc\r\nhello",
+			key:      "abc",
+			filename: "main.go",
+			rest:     "hello",
+		},
+		{
+			name:    "blank crlf line",
+			content: "!key abc\r\n\r\nhello",
+			key:     "abc",
+			rest:    "\r\nhello",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, rest, err := parseDirectives([]byte(tt.content))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if d.key != tt.key || d.filename != tt.filename || d.traceID != tt.traceID {
+				t.Errorf("expected key %q, filename %q and trace ID %q, got %q, %q and %q", tt.key, tt.filename, tt.traceID, d.key, d.filename, d.traceID)
+			}
+			if string(rest) != tt.rest {
+				t.Errorf("expected content %q, got %q", tt.rest, rest)
+			}
+		})
+	}
+}
+
+func TestParseDirectives_CRLFMaxDirectiveLine(t *testing.T) {
+	// The line ending doesn't count towards the maximum length.
+	setFlags(t, "--allow-custom-keys", "--max-directive-line=8")
+	d, rest, err := parseDirectives([]byte("!key abc\r\nhello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if d.key != "abc" || string(rest) != "hello" {
+		t.Errorf("expected key %q and content %q, got %q and %q", "abc", "hello", d.key, rest)
+	}
+}
+
+func TestParseDirectives_LeadingBlankLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		content string
+		key     string
+		rest    string
+	}{
+		{
+			name:    "disabled",
+			content: "\nhello",
+			rest:    "\nhello",
+		},
+		{
+			name:    "disabled crlf",
+			content: "\r\nhello",
+			rest:    "\r\nhello",
+		},
+		{
+			name:    "enabled",
+			args:    []string{"--allow-custom-keys"},
+			content: "\nhello",
+			rest:    "\nhello",
+		},
+		{
+			name:    "enabled crlf",
+			args:    []string{"--allow-custom-keys"},
+			content: "\r\nhello",
+			rest:    "\r\nhello",
+		},
+		{
+			// A directive after a blank line is content.
+			name:    "directive after blank line",
+			args:    []string{"--allow-custom-keys"},
+			content: "\n!key abc\nhello",
+			rest:    "\n!key abc\nhello",
+		},
+		{
+			// Parsing stops at the first line that isn't a directive.
+			name:    "directive after content",
+			args:    []string{"--allow-custom-keys"},
+			content: "!key abc\nhello\n!key def\n",
+			key:     "abc",
+			rest:    "hello\n!key def\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			d, rest, err := parseDirectives([]byte(tt.content))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if d.key != tt.key || string(rest) != tt.rest {
+				t.Errorf("expected key %q and content %q, got %q and %q", tt.key, tt.rest, d.key, rest)
+			}
+		})
+	}
+}
+
+func TestHandle_LeadingBlankLine(t *testing.T) {
+	for _, args := range [][]string{nil, {"--allow-custom-keys"}} {
+		setFlags(t, args...)
+		s, h := newTestServer(t, nil)
+		if _, err := roundTrip(t, s, "\nhello"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if docs := h.documents(); !slices.Equal(docs, []string{"\nhello"}) {
+			t.Errorf("expected the blank line to be kept with %q, got %q", args, docs)
+		}
+	}
+}
+
+func TestParseDirectives_MaxDirectives(t *testing.T) {
+	setFlags(t, "--allow-custom-keys", "--accept-client-trace-id", "--max-directives=2")
+	d, rest, err := parseDirectives([]byte("!trace-id t-1\n!trace-id t-2\n!key abc\nhello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Directive lines beyond the cap are treated as content.
+	if d.key != "" || d.traceID != "t-2" {
+		t.Errorf("expected key %q and trace ID %q, got %q and %q", "", "t-2", d.key, d.traceID)
+	}
+	if want := "!key abc\nhello"; string(rest) != want {
+		t.Errorf("expected content %q, got %q", want, rest)
+	}
+}
+
+func TestParseDirectives_MaxDirectivesFlood(t *testing.T) {
+	setFlags(t, "--accept-client-trace-id")
+	content := []byte(strings.Repeat("!trace-id t-1\n", 10_000) + "hello")
+	_, rest, err := parseDirectives(content)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// Only the default of 16 directive lines are parsed.
+	if want := len(content) - 16*len("!trace-id t-1\n"); len(rest) != want {
+		t.Errorf("expected %d bytes of content, got %d", want, len(rest))
+	}
+}
+
+func TestHandle_DirectivesOnly(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "single",
+			data: "!filename main.go\n",
+		},
+		{
+			name: "multiple",
+			data: "!key abc\n!filename main.go\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, "--allow-custom-keys", "--allow-filename", "--usage-message=usage")
+			s, h := newTestServer(t, nil)
+
+			res, err := roundTrip(t, s, tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := "usage\n"; res != want {
+				t.Errorf("expected response %q, got %q", want, res)
+			}
+			if docs := h.documents(); len(docs) > 0 {
+				t.Errorf("expected no documents to be uploaded, got %q", docs)
+			}
+		})
+	}
+}
+
+func TestParseDirectives_MaxDirectiveValue(t *testing.T) {
+	setFlags(t, "--accept-client-trace-id", "--max-directive-value=8")
+	tests := []struct {
+		name    string
+		content string
+		err     error
+	}{
+		{
+			name:    "at limit",
+			content: "!trace-id 12345678\nhello",
+		},
+		{
+			name:    "over limit",
+			content: "!trace-id 123456789\nhello",
+			err:     errDirectiveValueTooLong,
+		},
+		{
+			// The value is checked before it is validated.
+			name:    "invalid over limit",
+			content: "!trace-id " + strings.Repeat("!", 9) + "\nhello",
+			err:     errDirectiveValueTooLong,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := parseDirectives([]byte(tt.content))
+			if !errors.Is(err, tt.err) {
+				t.Errorf("expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestHandle_MaxDirectiveValue(t *testing.T) {
+	setFlags(t, "--allow-filename", "--max-directive-value=8")
+	s, h := newTestServer(t, nil)
+
+	res, err := roundTrip(t, s, "!filename longname.go\npackage main\n")
+	if !errors.Is(err, ErrInvalidDirective) {
+		t.Errorf("expected ErrInvalidDirective, got %v", err)
+	}
+	if want := "Directive values may not exceed 8 bytes\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+	if docs := h.documents(); len(docs) > 0 {
+		t.Errorf("expected no documents to be uploaded, got %q", docs)
+	}
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Error categories returned by handle, these allow Run to tell errors caused by clients apart
+// from internal ones using errors.Is (e.g. to choose the level they are logged at). Errors from
+// the connection itself (e.g. a failed write) are not categorized.
+var (
+	// ErrClient is the category of errors caused by the client, such as sending too much data.
+	ErrClient = errors.New("client error")
+	// ErrInternal is the category of errors caused by fiche or its upstream.
+	ErrInternal = errors.New("internal error")
+)
+
+// Client errors.
+var (
+	// ErrLimitExceeded is returned when a client sends more data than allowed.
+	ErrLimitExceeded = fmt.Errorf("%w: paste exceeds the size limit", ErrClient)
+	// ErrRejected is returned when a client or its paste is rejected by a policy, such as
+	// `--allowed-content-types` or `--require-ptr`.
+	ErrRejected = fmt.Errorf("%w: rejected", ErrClient)
+	// ErrTooManyReads is returned when a client sends a paste using more than
+	// `--max-reads-per-conn` reads.
+	ErrTooManyReads = fmt.Errorf("%w: too many reads", ErrClient)
+	// ErrInvalidDirective is returned when a client sends an invalid directive.
+	ErrInvalidDirective = fmt.Errorf("%w: invalid directive", ErrClient)
+	// ErrConnectionReset is returned when a client resets the connection while sending a paste
+	// and `--reset-action=discard` is used.
+	ErrConnectionReset = fmt.Errorf("%w: connection reset", ErrClient)
+)
+
+// Internal errors.
+var (
+	// ErrUpstream is returned when the haste-server fails to store a paste.
+	ErrUpstream = fmt.Errorf("%w: upstream failure", ErrInternal)
+	// ErrReadCapExceeded is returned when more than `--hard-read-cap` bytes were read from a
+	// connection, this indicates a bug in how the paste limit is enforced.
+	ErrReadCapExceeded = fmt.Errorf("%w: hard read cap exceeded", ErrInternal)
+)
+
+// respondWithError writes msg to the client and returns err, along with any error that
+// occurred while writing the response.
+func respondWithError(conn net.Conn, err error, msg string) error {
+	return errors.Join(err, writeResponse(conn, []byte(msg)))
+}
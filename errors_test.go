@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestHandle_ErrorCategories(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		handler  http.Handler
+		data     string
+		err      error
+		category error
+	}{
+		{
+			name:     "limit exceeded",
+			args:     []string{"--limit=5"},
+			data:     "hello world",
+			err:      ErrLimitExceeded,
+			category: ErrClient,
+		},
+		{
+			name:     "rejected",
+			args:     []string{"--allowed-content-types=text/*"},
+			data:     "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR",
+			err:      ErrRejected,
+			category: ErrClient,
+		},
+		{
+			name:     "invalid directive",
+			args:     []string{"--allow-custom-keys"},
+			data:     "!key ../etc\nhello",
+			err:      ErrInvalidDirective,
+			category: ErrClient,
+		},
+		{
+			name: "upstream failure",
+			handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(http.StatusInternalServerError)
+			}),
+			data:     "hello",
+			err:      ErrUpstream,
+			category: ErrInternal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			s, _ := newTestServer(t, tt.handler)
+
+			_, err := roundTripFunc(t, s, func(conn *net.TCPConn) error {
+				// The connection may be closed before all the data is sent.
+				_, _ = conn.Write([]byte(tt.data))
+				_ = conn.CloseWrite()
+				return nil
+			})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("expected %v, got %v", tt.err, err)
+			}
+			if !errors.Is(err, tt.category) {
+				t.Errorf("expected the error to be categorized as %v, got %v", tt.category, err)
+			}
+			for _, other := range []error{ErrClient, ErrInternal} {
+				if other != tt.category && errors.Is(err, other) {
+					t.Errorf("expected the error to not be categorized as %v, got %v", other, err)
+				}
+			}
+		})
+	}
+}
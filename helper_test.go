@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+// helperProcessEnv is set to the name of the helper test being run when the test binary is run
+// in a separate process by helperCommand.
+const helperProcessEnv = "FICHE_HELPER_PROCESS"
+
+// isHelperProcess returns true if t is being run in a separate process by helperCommand.
+//
+// Helper tests aren't real tests, they return immediately unless this returns true.
+func isHelperProcess(t *testing.T) bool {
+	return os.Getenv(helperProcessEnv) == t.Name()
+}
+
+// helperCommand returns a command running only the helper test with the provided name in a
+// separate process, with env added to its environment.
+//
+// This is used by tests doing something that would affect the rest of the tests or can't be
+// undone, such as receiving signals, being passed file descriptors or dropping privileges.
+func helperCommand(ctx context.Context, name string, env ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=^"+name+"$")
+	cmd.Env = append(append(os.Environ(), helperProcessEnv+"="+name), env...)
+	return cmd
+}
+
+// helperOutput runs cmd and returns what it wrote to stdout, failing the test if it fails.
+func helperOutput(t *testing.T, cmd *exec.Cmd) string {
+	t.Helper()
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("helper failed: %v: %s", err, out)
+	}
+	return string(out)
+}
@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// histogramBuckets is the number of buckets in a latencyHistogram, the upper bound of each
+// bucket is double the previous one starting at 1ms, so the last bucket covers up to ~65s.
+const histogramBuckets = 17
+
+// latencyHistogram is a lightweight histogram of latencies using exponential buckets.
+//
+// Percentiles are approximated using the upper bound of the bucket they fall in, which is
+// accurate to within a factor of two. This is plenty for a quick post-mortem.
+type latencyHistogram struct {
+	mu sync.Mutex
+	// buckets contains the number of observations in each bucket, with an extra bucket for any
+	// observations above the upper bound of the last bucket.
+	buckets [histogramBuckets + 1]uint64
+	count   uint64
+	max     time.Duration
+}
+
+// bucketBound returns the upper bound of the bucket at index i.
+func bucketBound(i int) time.Duration {
+	return time.Millisecond << i
+}
+
+// Observe records a latency.
+func (h *latencyHistogram) Observe(d time.Duration) {
+	i := 0
+	for i < histogramBuckets && d > bucketBound(i) {
+		i++
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets[i]++
+	h.count++
+	h.max = max(h.max, d)
+}
+
+// Count returns the number of recorded latencies.
+func (h *latencyHistogram) Count() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count
+}
+
+// Max returns the largest recorded latency.
+func (h *latencyHistogram) Max() time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.max
+}
+
+// Percentile returns the approximate latency at percentile p (between 0 and 1).
+func (h *latencyHistogram) Percentile(p float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count == 0 {
+		return 0
+	}
+	target := uint64(p * float64(h.count))
+	if target < 1 {
+		target = 1
+	}
+	var cumulative uint64
+	for i, n := range h.buckets {
+		cumulative += n
+		if cumulative < target {
+			continue
+		}
+		if i >= histogramBuckets {
+			return h.max
+		}
+		// The bucket's upper bound is never more than the largest observed latency.
+		return min(bucketBound(i), h.max)
+	}
+	return h.max
+}
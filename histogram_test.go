@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// observeLatencies records known latencies, with percentiles falling into different buckets.
+func observeLatencies(h *latencyHistogram) {
+	for range 50 {
+		h.Observe(time.Millisecond)
+	}
+	for range 40 {
+		h.Observe(3 * time.Millisecond)
+	}
+	for range 9 {
+		h.Observe(10 * time.Millisecond)
+	}
+	h.Observe(100 * time.Millisecond)
+}
+
+func TestLatencyHistogram(t *testing.T) {
+	var h latencyHistogram
+	if p := h.Percentile(0.5); p != 0 {
+		t.Errorf("expected 0 without any observations, got %s", p)
+	}
+
+	observeLatencies(&h)
+	if n := h.Count(); n != 100 {
+		t.Errorf("expected 100 observations, got %d", n)
+	}
+	if m := h.Max(); m != 100*time.Millisecond {
+		t.Errorf("expected a max of 100ms, got %s", m)
+	}
+	tests := []struct {
+		p    float64
+		want time.Duration
+	}{
+		{0, time.Millisecond},
+		{0.5, time.Millisecond},
+		{0.9, 4 * time.Millisecond},
+		{0.99, 16 * time.Millisecond},
+		{1, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := h.Percentile(tt.p); got != tt.want {
+			t.Errorf("expected %s at p%g, got %s", tt.want, tt.p*100, got)
+		}
+	}
+}
+
+func TestLatencyHistogram_Overflow(t *testing.T) {
+	var h latencyHistogram
+	h.Observe(time.Hour)
+	if p := h.Percentile(0.5); p != time.Hour {
+		t.Errorf("expected latencies above the last bucket to use the max, got %s", p)
+	}
+}
+
+func TestLogLatencySummary(t *testing.T) {
+	setFlags(t)
+	logs := captureLogs(t)
+	s := NewServer(nil, nil)
+
+	// Nothing is logged without any requests.
+	s.LogLatencySummary(context.Background())
+	if logs.String() != "" {
+		t.Errorf("expected no logs, got %q", logs.String())
+	}
+
+	observeLatencies(&s.latency)
+	s.LogLatencySummary(context.Background())
+	if want := `msg="upstream latency summary" count=100 p50=1ms p90=4ms p99=16ms max=100ms`; !strings.Contains(logs.String(), want) {
+		t.Errorf("expected the summary %q, got %q", want, logs.String())
+	}
+}
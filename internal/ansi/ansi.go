@@ -0,0 +1,84 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+// Package ansi provides removal of ANSI escape sequences (e.g. colors) from text.
+package ansi
+
+import "bytes"
+
+const (
+	esc = 0x1b
+	bel = 0x07
+)
+
+// Strip returns b with all ANSI escape sequences removed.
+//
+// CSI sequences (`ESC [ ... final`), OSC sequences (`ESC ] ... BEL` or `ESC ] ... ESC \`) and
+// other escape sequences (`ESC intermediate... final`) are removed, any other text is preserved
+// as-is. If b doesn't contain any escape sequences, b itself is returned.
+func Strip(b []byte) []byte {
+	i := bytes.IndexByte(b, esc)
+	if i < 0 {
+		return b
+	}
+
+	out := make([]byte, 0, len(b))
+	for i >= 0 {
+		out = append(out, b[:i]...)
+		b = b[i+sequenceLength(b[i:]):]
+		i = bytes.IndexByte(b, esc)
+	}
+	return append(out, b...)
+}
+
+// sequenceLength returns the length of the escape sequence at the start of b, b[0] must be ESC.
+//
+// An unterminated sequence is considered to run until the end of b.
+func sequenceLength(b []byte) int {
+	if len(b) < 2 {
+		return len(b)
+	}
+
+	switch b[1] {
+	case '[':
+		// CSI: parameter and intermediate bytes (0x20-0x3F), terminated by a final byte
+		// (0x40-0x7E).
+		for i := 2; i < len(b); i++ {
+			if b[i] >= 0x40 && b[i] <= 0x7e {
+				return i + 1
+			}
+			if b[i] < 0x20 || b[i] > 0x3f {
+				// Not a valid CSI sequence, strip the introducer and the parameter bytes read so
+				// far but keep the invalid byte.
+				return i
+			}
+		}
+		return len(b)
+	case ']':
+		// OSC: terminated by BEL or ST (`ESC \`).
+		for i := 2; i < len(b); i++ {
+			if b[i] == bel {
+				return i + 1
+			}
+			if b[i] == esc && i+1 < len(b) && b[i+1] == '\\' {
+				return i + 2
+			}
+		}
+		return len(b)
+	default:
+		// Any number of intermediate bytes (0x20-0x2F), terminated by a final byte (0x30-0x7E).
+		// This covers two-byte sequences such as `ESC c` (reset) or `ESC =` (keypad mode), and
+		// ones with intermediate bytes such as `ESC ( B` (select character set).
+		for i := 1; i < len(b); i++ {
+			if b[i] >= 0x30 && b[i] <= 0x7e {
+				return i + 1
+			}
+			if b[i] < 0x20 || b[i] > 0x2f {
+				// Not a valid escape sequence, strip the ESC and any intermediate bytes read so
+				// far but keep the invalid byte.
+				return i
+			}
+		}
+		return len(b)
+	}
+}
@@ -0,0 +1,36 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package ansi
+
+import "testing"
+
+func TestStrip(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello world", "hello world"},
+		{"color", "\x1b[31mred\x1b[0m text", "red text"},
+		{"cursor", "a\x1b[2Kb\x1b[1;2Hc", "abc"},
+		{"osc bel", "\x1b]0;title\x07text", "text"},
+		{"osc st", "\x1b]8;;https://example.com\x1b\\link\x1b]8;;\x1b\\", "link"},
+		{"two byte", "\x1bcreset", "reset"},
+		{"intermediate", "\x1b(0q\x1b(Bline", "qline"},
+		{"tput sgr0", "\x1b[1mbold\x1b(B\x1b[m done", "bold done"},
+		{"invalid intermediate", "\x1b(\nnext", "\nnext"},
+		{"unterminated intermediate", "text\x1b(", "text"},
+		{"invalid csi", "\x1b[12\nnext", "\nnext"},
+		{"unterminated csi", "text\x1b[31", "text"},
+		{"trailing escape", "text\x1b", "text"},
+		{"utf-8", "\x1b[1mé\x1b[0m", "é"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Strip([]byte(tt.in)); string(got) != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+// Package encrypt provides AES-GCM encryption of pastes, so that the haste-server only ever
+// stores ciphertext.
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+)
+
+// KeySize is the size of generated keys in bytes (AES-256).
+const KeySize = 32
+
+// NewKey returns a new randomly generated key.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("failed to generate key: %w", err)
+	}
+	return key, nil
+}
+
+// Seal encrypts plaintext using AES-GCM with the provided key.
+//
+// The returned ciphertext is the randomly generated nonce followed by the sealed plaintext,
+// encoded using standard base64 so it can be safely stored by a haste-server.
+func Seal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gcm: %w", err)
+	}
+
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, plaintext, nil)
+
+	ciphertext := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(ciphertext, sealed)
+	return ciphertext, nil
+}
+
+// Fragment returns the URL fragment (without the leading `#`) used to pass key to a client.
+func Fragment(key []byte) string {
+	return "key=" + base64.RawURLEncoding.EncodeToString(key)
+}
@@ -0,0 +1,80 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package encrypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// open decrypts ciphertext returned by Seal, as a client would.
+func open(t *testing.T, key, ciphertext []byte) []byte {
+	t.Helper()
+	sealed, err := base64.StdEncoding.DecodeString(string(ciphertext))
+	if err != nil {
+		t.Fatalf("failed to decode ciphertext: %v", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatalf("failed to create cipher: %v", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("failed to create gcm: %v", err)
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		t.Fatalf("failed to decrypt ciphertext: %v", err)
+	}
+	return plaintext
+}
+
+func TestSeal(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	if len(key) != KeySize {
+		t.Fatalf("expected a key of %d bytes, got %d", KeySize, len(key))
+	}
+
+	plaintext := []byte("hello world")
+	ciphertext, err := Seal(key, plaintext)
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Error("expected the ciphertext not to contain the plaintext")
+	}
+	if got := open(t, key, ciphertext); !bytes.Equal(got, plaintext) {
+		t.Errorf("expected %q, got %q", plaintext, got)
+	}
+
+	// Every seal uses a new nonce.
+	again, err := Seal(key, plaintext)
+	if err != nil {
+		t.Fatalf("failed to seal: %v", err)
+	}
+	if bytes.Equal(ciphertext, again) {
+		t.Error("expected sealing the same plaintext twice to return different ciphertexts")
+	}
+}
+
+func TestFragment(t *testing.T) {
+	key := bytes.Repeat([]byte{0xff}, KeySize)
+	fragment := Fragment(key)
+	encoded, ok := strings.CutPrefix(fragment, "key=")
+	if !ok {
+		t.Fatalf("expected the fragment to start with %q, got %q", "key=", fragment)
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || !bytes.Equal(decoded, key) {
+		t.Errorf("expected the fragment to contain the key, got %q (%v)", fragment, err)
+	}
+}
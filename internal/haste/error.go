@@ -4,11 +4,42 @@
 package haste
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"regexp"
+	"unicode/utf8"
 )
 
+// ErrKeyTaken is returned when a paste is requested with a key that is already in use.
+var ErrKeyTaken = errors.New("haste: key is already taken")
+
+// ErrEmptyResponse is returned when the haste-server accepts a paste but responds without a
+// body (or location), so the key of the document is unknown.
+var ErrEmptyResponse = errors.New("haste: upstream returned empty response")
+
+// ResolveError indicates the hostname of the haste-server could not be resolved.
+type ResolveError struct {
+	// Host that could not be resolved.
+	Host string
+
+	// Err is the underlying error, usually a *net.DNSError.
+	Err error
+}
+
+var _ error = (*ResolveError)(nil)
+
+// Error satisfies the error interface.
+func (e *ResolveError) Error() string {
+	return "cannot resolve upstream host " + e.Host + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *ResolveError) Unwrap() error {
+	return e.Err
+}
+
 // StatusError indicates an HTTP request failure with a status code from a remote
 // HTTP server.
 type StatusError struct {
@@ -20,6 +51,11 @@ type StatusError struct {
 
 	// Expected StatusCode the response should've had.
 	Expected int
+
+	// dataLimit is the maximum number of bytes of Data to include in Error, zero means no limit.
+	dataLimit int
+	// redact contains patterns that are redacted from Data in Error.
+	redact []*regexp.Regexp
 }
 
 var _ error = StatusError{}
@@ -30,10 +66,8 @@ func newStatusError(res *http.Response, expected int) StatusError {
 		StatusCode: res.StatusCode,
 		Expected:   expected,
 	}
+	// The body is intentionally not closed here, it is the responsibility of the caller.
 	if res.Body != nil {
-		defer func() {
-			_ = res.Body.Close()
-		}()
 		body := io.LimitReader(res.Body, 4*1024)
 		if b, err := io.ReadAll(body); err == nil {
 			e.Data = b
@@ -42,10 +76,67 @@ func newStatusError(res *http.Response, expected int) StatusError {
 	return e
 }
 
+// statusError returns a new status error using information from the request, with its data
+// redacted and truncated as configured on the client.
+func (c *Client) statusError(res *http.Response, expected int) StatusError {
+	e := newStatusError(res, expected)
+	e.dataLimit = c.ErrorDataLimit
+	e.redact = c.ErrorRedact
+	return e
+}
+
 // Error satisfies the error interface.
+//
+// Data is included in the error, redacted and truncated as configured on the Client. The full
+// Data is always available on the struct itself.
 func (e StatusError) Error() string {
 	if len(e.Data) > 0 {
-		return fmt.Sprintf("expected %d status code, but got %d (%s)", e.Expected, e.StatusCode, string(e.Data))
+		return fmt.Sprintf("expected %d status code, but got %d (%s)", e.Expected, e.StatusCode, e.data())
 	}
 	return fmt.Sprintf("expected %d status code, but got %d", e.Expected, e.StatusCode)
 }
+
+// data returns the redacted and truncated data to include in Error.
+func (e StatusError) data() string {
+	return formatData(e.Data, e.dataLimit, e.redact)
+}
+
+// ContentTypeError indicates the haste-server responded with something other than JSON, such as
+// an error page from a misconfigured proxy.
+type ContentTypeError struct {
+	// ContentType of the response.
+	ContentType string
+
+	// Data from the response.
+	Data []byte
+
+	// dataLimit is the maximum number of bytes of Data to include in Error, zero means no limit.
+	dataLimit int
+	// redact contains patterns that are redacted from Data in Error.
+	redact []*regexp.Regexp
+}
+
+var _ error = ContentTypeError{}
+
+// Error satisfies the error interface.
+//
+// Data is included in the error, redacted and truncated as configured on the Client.
+func (e ContentTypeError) Error() string {
+	return fmt.Sprintf("upstream returned non-JSON response (%s): %s", e.ContentType, formatData(e.Data, e.dataLimit, e.redact))
+}
+
+// formatData returns data with the redact patterns replaced, truncated to limit bytes.
+func formatData(data []byte, limit int, redact []*regexp.Regexp) string {
+	for _, re := range redact {
+		data = re.ReplaceAllLiteral(data, []byte("[REDACTED]"))
+	}
+	if limit > 0 && len(data) > limit {
+		// Avoid cutting a multi-byte character in half.
+		n := limit
+		for n > 0 && !utf8.RuneStart(data[n]) {
+			n--
+		}
+		return string(data[:n]) + "…"
+	}
+	return string(data)
+}
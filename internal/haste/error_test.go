@@ -0,0 +1,151 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package haste
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestFormatData(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		limit  int
+		redact []string
+		want   string
+	}{
+		{
+			name: "no limit",
+			data: "hello world",
+			want: "hello world",
+		},
+		{
+			name:  "under limit",
+			data:  "hello",
+			limit: 5,
+			want:  "hello",
+		},
+		{
+			name:  "over limit",
+			data:  "hello world",
+			limit: 5,
+			want:  "hello…",
+		},
+		{
+			name:  "multi-byte character",
+			data:  "héllo",
+			limit: 2,
+			want:  "h…",
+		},
+		{
+			name:   "redacted",
+			data:   "token=abc123 ok",
+			redact: []string{`token=\w+`},
+			want:   "[REDACTED] ok",
+		},
+		{
+			name:   "redacted before truncating",
+			data:   "token=abc123 ok",
+			limit:  10,
+			redact: []string{`token=\w+`},
+			want:   "[REDACTED]…",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var redact []*regexp.Regexp
+			for _, pattern := range tt.redact {
+				redact = append(redact, regexp.MustCompile(pattern))
+			}
+			if got := formatData([]byte(tt.data), tt.limit, redact); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestStatusError_Truncated(t *testing.T) {
+	body := strings.Repeat("a", 100)
+	c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(body))
+	})
+	c.ErrorDataLimit = 10
+
+	_, err := c.Paste(context.Background(), strings.NewReader("hello"))
+	var statusErr StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected a StatusError, got %v", err)
+	}
+	if want := "expected 200 status code, but got 502 (" + body[:10] + "…)"; statusErr.Error() != want {
+		t.Errorf("expected %q, got %q", want, statusErr.Error())
+	}
+	// The full body is still available to callers.
+	if string(statusErr.Data) != body {
+		t.Errorf("expected the full body, got %q", statusErr.Data)
+	}
+}
+
+func TestContentTypeError(t *testing.T) {
+	body := "<html><body><h1>Welcome to nginx!</h1></body></html>"
+	c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(body))
+	})
+	c.ErrorDataLimit = 20
+
+	_, err := c.Paste(context.Background(), strings.NewReader("hello"))
+	var ctErr ContentTypeError
+	if !errors.As(err, &ctErr) {
+		t.Fatalf("expected a ContentTypeError, got %v", err)
+	}
+	if want := "upstream returned non-JSON response (text/html; charset=utf-8): " + body[:20] + "…"; ctErr.Error() != want {
+		t.Errorf("expected %q, got %q", want, ctErr.Error())
+	}
+	if string(ctErr.Data) != body {
+		t.Errorf("expected the full body, got %q", ctErr.Data)
+	}
+}
+
+func TestContentTypeError_JSON(t *testing.T) {
+	// JSON responses using a content type with parameters or a vendor suffix are still accepted.
+	for _, ct := range []string{"application/json; charset=utf-8", "application/vnd.haste+json"} {
+		c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", ct)
+			_, _ = w.Write([]byte(`{"key":"abc"}`))
+		})
+
+		res, err := c.Paste(context.Background(), strings.NewReader("hello"))
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %v", ct, err)
+		}
+		if res.Key != "abc" {
+			t.Errorf("expected key %q, got %q", "abc", res.Key)
+		}
+	}
+}
+
+func TestStatusError_MaxLength(t *testing.T) {
+	// Errors from the config endpoint are redacted and truncated the same as uploads.
+	c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte("token=abc123 " + strings.Repeat("a", 100)))
+	})
+	c.ErrorDataLimit = 12
+	c.ErrorRedact = []*regexp.Regexp{regexp.MustCompile(`token=\w+`)}
+
+	_, err := c.MaxLength(context.Background())
+	var statusErr StatusError
+	if !errors.As(err, &statusErr) {
+		t.Fatalf("expected a StatusError, got %v", err)
+	}
+	if want := "expected 200 status code, but got 502 ([REDACTED] a…)"; statusErr.Error() != want {
+		t.Errorf("expected %q, got %q", want, statusErr.Error())
+	}
+}
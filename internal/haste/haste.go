@@ -6,10 +6,19 @@ package haste
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"path"
+	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Client represents a Hastebin API client.
@@ -17,30 +26,138 @@ type Client struct {
 	// URL of the Hastebin instance.
 	URL string
 
+	// Method is the HTTP method used to create pastes, defaults to POST.
+	Method string
+
+	// Timeout is the maximum duration of a request to the haste-server, zero means no timeout.
+	Timeout time.Duration
+
+	// ConnectTimeout is the maximum duration of establishing a connection to the haste-server,
+	// separate from (and bounded by) Timeout. This allows failing fast when the haste-server is
+	// unreachable rather than slow. Zero means only Timeout applies.
+	ConnectTimeout time.Duration
+
+	// ColdStartTimeout is used instead of Timeout for the first request after the haste-server
+	// has not been used for ColdStartAfter. This allows a haste-server that scales to zero more
+	// time to start up. Zero disables cold start detection.
+	ColdStartTimeout time.Duration
+	// ColdStartAfter is the period of inactivity after which the haste-server is assumed to
+	// have scaled down.
+	ColdStartAfter time.Duration
+
+	// ErrorDataLimit is the maximum number of bytes of a response body included in the message
+	// of a StatusError, zero means no limit.
+	ErrorDataLimit int
+	// ErrorRedact contains patterns that are redacted from response bodies included in the
+	// message of a StatusError.
+	ErrorRedact []*regexp.Regexp
+
+	// MaxConcurrent is the maximum number of requests that may be in-flight to the haste-server
+	// at once, any further requests wait for an earlier one to complete. Zero means no limit.
+	//
+	// MaxConcurrent must not be changed after the first request has been made.
+	MaxConcurrent int
+
+	// ObserveLatency, if set, is called with the duration of every request to create a paste,
+	// excluding any time spent waiting for a request slot.
+	ObserveLatency func(time.Duration)
+
 	http *http.Client
+
+	// sem limits the number of concurrent requests, it is initialized on the first request.
+	sem     chan struct{}
+	semOnce sync.Once
+
+	// lastRequest is the time a response was last received, as Unix nanoseconds.
+	lastRequest atomic.Int64
 }
 
 // NewClient returns a new Hastebin client.
 func NewClient(url string) (*Client, error) {
-	return &Client{
-		URL:  strings.TrimSuffix(url, "/"),
-		http: &http.Client{},
-	}, nil
+	c := &Client{
+		URL: strings.TrimSuffix(url, "/"),
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = c.dialContext
+	c.http = &http.Client{Transport: t}
+	return c, nil
+}
+
+// dialKeepAlive is the keep-alive period for connections to the haste-server, matching
+// http.DefaultTransport.
+const dialKeepAlive = 30 * time.Second
+
+// dialContext establishes a connection to the haste-server, using ConnectTimeout.
+func (c *Client) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := &net.Dialer{
+		Timeout:   c.ConnectTimeout,
+		KeepAlive: dialKeepAlive,
+	}
+	return d.DialContext(ctx, network, addr)
 }
 
 // PasteResponse is the response from a Paste request.
 type PasteResponse struct {
 	Key string `json:"key"`
+
+	// URL is the absolute URL of the document, if the haste-server returned one using either a
+	// `Location` header or a `url` field. Relative URLs are resolved against the URL of the
+	// haste-server.
+	URL string `json:"url"`
 }
 
 // Paste sends a paste to the haste-server.
 func (c *Client) Paste(ctx context.Context, r io.Reader) (*PasteResponse, error) {
+	return c.paste(ctx, "/documents", r)
+}
+
+// PasteWithKey sends a paste to the haste-server, requesting that it be stored using the
+// provided key rather than a randomly generated one.
+//
+// This requires a haste-server that supports custom keys using `POST /documents/{key}`. If the
+// key is already in use, ErrKeyTaken is returned.
+func (c *Client) PasteWithKey(ctx context.Context, key string, r io.Reader) (*PasteResponse, error) {
+	return c.paste(ctx, "/documents/"+url.PathEscape(key), r)
+}
+
+// paste sends a paste to the provided path on the haste-server.
+func (c *Client) paste(ctx context.Context, path string, r io.Reader) (*PasteResponse, error) {
+	// The timeout includes waiting for a request slot, so a saturated haste-server can't keep
+	// requests waiting forever.
+	if timeout := c.timeout(time.Now()); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if c.ObserveLatency != nil {
+		start := time.Now()
+		defer func() { c.ObserveLatency(time.Since(start)) }()
+	}
+
 	// Send a request to the hastebin instance to create a new paste.
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL+"/documents", r)
+	method := c.Method
+	if method == "" {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, r)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create http request: %w", err)
 	}
 
+	// `http.NewRequest` only knows the length of a few reader types, for anything else the
+	// request would be sent using chunked encoding. Some haste-servers reject requests without a
+	// `Content-Length`, so it is sent whenever the length is known (e.g. a paste spilled to disk).
+	if sized, ok := r.(interface{ Size() int64 }); ok && req.ContentLength == 0 && sized.Size() > 0 {
+		req.ContentLength = sized.Size()
+	}
+
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-Type", "application/octet-stream")
 	req.Header.Set("User-Agent", "github.com/matthewpi/fiche")
@@ -48,20 +165,224 @@ func (c *Client) Paste(ctx context.Context, r io.Reader) (*PasteResponse, error)
 	// Run the request
 	res, err := c.http.Do(req)
 	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return nil, &ResolveError{Host: req.URL.Hostname(), Err: dnsErr}
+		}
 		return nil, fmt.Errorf("failed to execute http request: %w", err)
 	}
-	defer res.Body.Close()
+	defer drainAndClose(res.Body)
+	c.lastRequest.Store(time.Now().UnixNano())
+
+	// A conflict means a paste already exists with the requested key.
+	if res.StatusCode == http.StatusConflict {
+		return nil, ErrKeyTaken
+	}
 
 	// Handle non 200 and 201 status codes.
 	if res.StatusCode < http.StatusOK || res.StatusCode > http.StatusCreated {
-		return nil, newStatusError(res, http.StatusOK)
+		return nil, c.statusError(res, http.StatusOK)
 	}
 
-	// Decode the response.
+	// Decode the response, a body is optional if the document's location was provided.
+	//
+	// If the location was provided the document has already been created, so a body that isn't
+	// JSON (e.g. a plain-text "Created") is ignored rather than orphaning the document.
 	var paste PasteResponse
-	if err := json.NewDecoder(res.Body).Decode(&paste); err != nil {
-		return nil, fmt.Errorf("failed to decode response body: %w", err)
+	location := res.Header.Get("Location")
+	ct := res.Header.Get("Content-Type")
+	switch {
+	case ct != "" && !isJSON(ct):
+		if location == "" {
+			data, _ := io.ReadAll(io.LimitReader(res.Body, 4*1024))
+			return nil, ContentTypeError{ContentType: ct, Data: data, dataLimit: c.ErrorDataLimit, redact: c.ErrorRedact}
+		}
+	default:
+		if err := json.NewDecoder(res.Body).Decode(&paste); err != nil {
+			switch {
+			case location != "":
+				paste = PasteResponse{}
+			case errors.Is(err, io.EOF):
+				return nil, ErrEmptyResponse
+			default:
+				return nil, fmt.Errorf("failed to decode response body: %w", err)
+			}
+		}
+	}
+	if err := c.normalize(&paste, location); err != nil {
+		return nil, err
 	}
-
 	return &paste, nil
 }
+
+// normalize resolves the URL of a paste response against the URL of the haste-server, making
+// sure both the key and URL are set if the haste-server returned a location for the document.
+//
+// Some haste-servers return the location of the document as the key, this is treated the same
+// as a `Location` header.
+func (c *Client) normalize(paste *PasteResponse, location string) error {
+	if paste.URL != "" {
+		location = paste.URL
+	}
+	if location == "" && strings.Contains(paste.Key, "/") {
+		location, paste.Key = paste.Key, ""
+	}
+	if location == "" {
+		if paste.Key == "" {
+			return errors.New("haste-server did not return a key for the document")
+		}
+		return nil
+	}
+
+	base, err := url.Parse(c.URL + "/")
+	if err != nil {
+		return fmt.Errorf("failed to parse haste-server url: %w", err)
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return fmt.Errorf("failed to parse document location: %w", err)
+	}
+	u := base.ResolveReference(ref)
+	paste.URL = u.String()
+	if paste.Key == "" {
+		paste.Key = path.Base(u.Path)
+		if paste.Key == "/" || paste.Key == "." {
+			return fmt.Errorf("failed to determine key from document location %q", location)
+		}
+	}
+	return nil
+}
+
+// isJSON returns true if the media type of contentType is JSON (e.g. `application/json` or
+// `application/problem+json`).
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// timeout returns the timeout to use for a request made at now.
+func (c *Client) timeout(now time.Time) time.Duration {
+	if c.ColdStartTimeout <= 0 {
+		return c.Timeout
+	}
+	last := c.lastRequest.Load()
+	if last == 0 || now.Sub(time.Unix(0, last)) >= c.ColdStartAfter {
+		return c.ColdStartTimeout
+	}
+	return c.Timeout
+}
+
+// acquire waits for a request slot to become available, returning a function that releases it.
+func (c *Client) acquire(ctx context.Context) (func(), error) {
+	c.semOnce.Do(func() {
+		if c.MaxConcurrent > 0 {
+			c.sem = make(chan struct{}, c.MaxConcurrent)
+		}
+	})
+	if c.sem == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case c.sem <- struct{}{}:
+		return func() { <-c.sem }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("failed to wait for an available request slot: %w", ctx.Err())
+	}
+}
+
+// maxDrainSize is the maximum amount of data that will be drained from a response body before
+// closing it. Bodies larger than this will cause the underlying connection to not be reused.
+const maxDrainSize = 64 * 1024
+
+// drainAndClose drains any unread data from a response body then closes it.
+//
+// The transport can only reuse a keep-alive connection if the previous response body was read
+// in its entirety, which may not be the case if decoding failed or the body was ignored.
+func drainAndClose(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, maxDrainSize))
+	_ = body.Close()
+}
+
+// Raw returns the raw content of the document with the provided key, reading at most limit
+// bytes of it. A limit of zero or less means no limit.
+func (c *Client) Raw(ctx context.Context, key string, limit int64) ([]byte, error) {
+	release, err := c.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/raw/"+url.PathEscape(key), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http request: %w", err)
+	}
+	req.Header.Set("User-Agent", "github.com/matthewpi/fiche")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute http request: %w", err)
+	}
+	defer drainAndClose(res.Body)
+	c.lastRequest.Store(time.Now().UnixNano())
+
+	if res.StatusCode != http.StatusOK {
+		return nil, c.statusError(res, http.StatusOK)
+	}
+
+	var r io.Reader = res.Body
+	if limit > 0 {
+		r = io.LimitReader(r, limit)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	return b, nil
+}
+
+// configResponse is the response from a `GET /config` request.
+type configResponse struct {
+	MaxLength int `json:"maxLength"`
+}
+
+// MaxLength returns the maximum document size advertised by the haste-server.
+//
+// This requires a haste-server that exposes its configuration using `GET /config`, returning a
+// JSON object with a `maxLength` field.
+func (c *Client) MaxLength(ctx context.Context) (int, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/config", nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create http request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", "github.com/matthewpi/fiche")
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute http request: %w", err)
+	}
+	defer drainAndClose(res.Body)
+
+	if res.StatusCode != http.StatusOK {
+		return 0, c.statusError(res, http.StatusOK)
+	}
+
+	var config configResponse
+	if err := json.NewDecoder(res.Body).Decode(&config); err != nil {
+		return 0, fmt.Errorf("failed to decode response body: %w", err)
+	}
+	if config.MaxLength < 1 {
+		return 0, errors.New("haste-server did not advertise a maximum document size")
+	}
+	return config.MaxLength, nil
+}
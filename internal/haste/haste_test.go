@@ -0,0 +1,571 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package haste
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client for a haste-server using handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	c, err := NewClient(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	return c
+}
+
+func TestClient_Paste_Location(t *testing.T) {
+	tests := []struct {
+		name        string
+		location    string
+		contentType string
+		body        string
+		key         string
+		url         string
+	}{
+		{
+			name:     "no body",
+			location: "/abc",
+			key:      "abc",
+			url:      "/abc",
+		},
+		{
+			name:     "relative with query",
+			location: "/docs/abc?t=1",
+			key:      "abc",
+			url:      "/docs/abc?t=1",
+		},
+		{
+			name:     "absolute",
+			location: "https://cdn.example/p/abc",
+			key:      "abc",
+			url:      "https://cdn.example/p/abc",
+		},
+		{
+			name:        "plain text body",
+			location:    "/abc?t=1",
+			contentType: "text/plain",
+			body:        "Created",
+			key:         "abc",
+			url:         "/abc?t=1",
+		},
+		{
+			name:     "invalid json body",
+			location: "/abc",
+			body:     "Created",
+			key:      "abc",
+			url:      "/abc",
+		},
+		{
+			name:        "json body",
+			location:    "/p/abc",
+			contentType: "application/json",
+			body:        `{"key":"xyz"}`,
+			key:         "xyz",
+			url:         "/p/abc",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Location", tt.location)
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte(tt.body))
+			})
+
+			res, err := c.Paste(context.Background(), strings.NewReader("hello"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res.Key != tt.key {
+				t.Errorf("expected key %q, got %q", tt.key, res.Key)
+			}
+			url := tt.url
+			if strings.HasPrefix(url, "/") {
+				url = c.URL + url
+			}
+			if res.URL != url {
+				t.Errorf("expected url %q, got %q", url, res.URL)
+			}
+		})
+	}
+}
+
+func TestClient_Paste_TimeoutIncludesSlotWait(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"key":"abc"}`))
+	})
+	c.MaxConcurrent = 1
+	c.Timeout = 100 * time.Millisecond
+	var observed atomic.Int64
+	c.ObserveLatency = func(time.Duration) { observed.Add(1) }
+
+	// Occupy the only request slot.
+	release, err := c.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("failed to acquire request slot: %v", err)
+	}
+
+	start := time.Now()
+	_, err = c.Paste(context.Background(), strings.NewReader("hello"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the timeout to apply while waiting for a slot, waited %s", elapsed)
+	}
+	// The request was never sent, so its latency isn't observed.
+	if n := observed.Load(); n != 0 {
+		t.Errorf("expected no observed requests, got %d", n)
+	}
+
+	release()
+	if _, err := c.Paste(context.Background(), strings.NewReader("hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := observed.Load(); n != 1 {
+		t.Errorf("expected 1 observed request, got %d", n)
+	}
+}
+
+func TestClient_Paste_ContentLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		r       io.Reader
+		chunked bool
+	}{
+		{
+			name: "bytes",
+			r:    bytes.NewReader([]byte("hello")),
+		},
+		{
+			name: "section",
+			r:    io.NewSectionReader(strings.NewReader("hello world"), 0, 5),
+		},
+		{
+			name:    "unknown length",
+			r:       io.MultiReader(strings.NewReader("hel"), strings.NewReader("lo")),
+			chunked: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				contentLength    int64
+				transferEncoding []string
+				body             []byte
+			)
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				contentLength, transferEncoding = r.ContentLength, r.TransferEncoding
+				body, _ = io.ReadAll(r.Body)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"key":"abc"}`))
+			})
+
+			if _, err := c.Paste(context.Background(), tt.r); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(body) != "hello" {
+				t.Errorf("expected body %q, got %q", "hello", body)
+			}
+			if tt.chunked {
+				if contentLength != -1 || !slices.Equal(transferEncoding, []string{"chunked"}) {
+					t.Errorf("expected a chunked request, got content length %d and transfer encoding %q", contentLength, transferEncoding)
+				}
+				return
+			}
+			if contentLength != 5 || len(transferEncoding) > 0 {
+				t.Errorf("expected a content length of 5, got %d and transfer encoding %q", contentLength, transferEncoding)
+			}
+		})
+	}
+}
+
+func TestClient_Paste_ColdStart(t *testing.T) {
+	var delay atomic.Int64
+	c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(time.Duration(delay.Load()))
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"key":"abc"}`))
+	})
+	c.Timeout = 100 * time.Millisecond
+	c.ColdStartTimeout = 2 * time.Second
+	c.ColdStartAfter = time.Minute
+
+	// The first request is given the cold start timeout.
+	delay.Store(int64(300 * time.Millisecond))
+	if _, err := c.Paste(context.Background(), strings.NewReader("hello")); err != nil {
+		t.Fatalf("expected the first request to use the cold start timeout, got %v", err)
+	}
+
+	// Later requests use the regular timeout.
+	delay.Store(0)
+	if _, err := c.Paste(context.Background(), strings.NewReader("hello")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	delay.Store(int64(300 * time.Millisecond))
+	if _, err := c.Paste(context.Background(), strings.NewReader("hello")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	c := &Client{Timeout: time.Second, ColdStartTimeout: time.Minute, ColdStartAfter: 5 * time.Minute}
+	now := time.Now()
+	if got := c.timeout(now); got != time.Minute {
+		t.Errorf("expected the cold start timeout before the first request, got %s", got)
+	}
+	c.lastRequest.Store(now.UnixNano())
+	if got := c.timeout(now.Add(time.Minute)); got != time.Second {
+		t.Errorf("expected the regular timeout, got %s", got)
+	}
+	if got := c.timeout(now.Add(5 * time.Minute)); got != time.Minute {
+		t.Errorf("expected the cold start timeout after being idle, got %s", got)
+	}
+
+	c.ColdStartTimeout = 0
+	if got := c.timeout(now.Add(time.Hour)); got != time.Second {
+		t.Errorf("expected the regular timeout without cold start detection, got %s", got)
+	}
+}
+
+func TestClient_Paste_MaxConcurrent(t *testing.T) {
+	var inFlight, peak atomic.Int64
+	c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"key":"abc"}`))
+	})
+	c.MaxConcurrent = 2
+
+	errs := make(chan error, 8)
+	for range cap(errs) {
+		go func() {
+			_, err := c.Paste(context.Background(), strings.NewReader("hello"))
+			errs <- err
+		}()
+	}
+	for range cap(errs) {
+		if err := <-errs; err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if p := peak.Load(); p > 2 {
+		t.Errorf("expected at most 2 concurrent requests, got %d", p)
+	}
+}
+
+func TestClient_Paste_Unresolvable(t *testing.T) {
+	c, err := NewClient("http://fiche.invalid")
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	_, err = c.Paste(context.Background(), strings.NewReader("hello"))
+	var resolveErr *ResolveError
+	if !errors.As(err, &resolveErr) {
+		t.Fatalf("expected a *ResolveError, got %v", err)
+	}
+	if resolveErr.Host != "fiche.invalid" {
+		t.Errorf("expected host %q, got %q", "fiche.invalid", resolveErr.Host)
+	}
+}
+
+func TestClient_Paste_ConnectionReuse(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{
+			name:   "decode error",
+			status: http.StatusOK,
+			body:   "not json" + strings.Repeat(" ", 16*1024),
+		},
+		{
+			name:   "error status",
+			status: http.StatusInternalServerError,
+			body:   strings.Repeat("a", 16*1024),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fail atomic.Bool
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if fail.Load() {
+					w.WriteHeader(tt.status)
+					_, _ = w.Write([]byte(tt.body))
+					return
+				}
+				_, _ = w.Write([]byte(`{"key":"abc"}`))
+			}))
+			var conns atomic.Int64
+			srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					conns.Add(1)
+				}
+			}
+			srv.Start()
+			t.Cleanup(srv.Close)
+			c, err := NewClient(srv.URL)
+			if err != nil {
+				t.Fatalf("failed to create client: %v", err)
+			}
+
+			fail.Store(true)
+			if _, err := c.Paste(context.Background(), strings.NewReader("hello")); err == nil {
+				t.Fatal("expected an error")
+			}
+			fail.Store(false)
+			if _, err := c.Paste(context.Background(), strings.NewReader("hello")); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if n := conns.Load(); n != 1 {
+				t.Errorf("expected the connection to be reused, got %d connections", n)
+			}
+		})
+	}
+}
+
+// trackingBody is an io.ReadCloser recording how much data was read and whether it was closed.
+type trackingBody struct {
+	io.Reader
+	read   int
+	closed bool
+}
+
+func (b *trackingBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	b.read += n
+	return n, err
+}
+
+func (b *trackingBody) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestDrainAndClose(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		read int
+	}{
+		{name: "empty", size: 0, read: 0},
+		{name: "small", size: 1024, read: 1024},
+		{name: "limit", size: maxDrainSize, read: maxDrainSize},
+		{name: "over limit", size: 2 * maxDrainSize, read: maxDrainSize},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := &trackingBody{Reader: strings.NewReader(strings.Repeat("a", tt.size))}
+			drainAndClose(body)
+			if body.read != tt.read {
+				t.Errorf("expected %d bytes to be drained, got %d", tt.read, body.read)
+			}
+			if !body.closed {
+				t.Error("expected the body to be closed")
+			}
+		})
+	}
+}
+
+func TestClient_Paste_Method(t *testing.T) {
+	for _, method := range []string{"", http.MethodPost, http.MethodPut, http.MethodPatch} {
+		var got string
+		c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+			got = r.Method
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"key":"abc"}`))
+		})
+		c.Method = method
+
+		if _, err := c.Paste(context.Background(), strings.NewReader("hello")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		want := method
+		if want == "" {
+			want = http.MethodPost
+		}
+		if got != want {
+			t.Errorf("expected method %q, got %q", want, got)
+		}
+	}
+}
+
+func TestClient_MaxLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   int
+	}{
+		{
+			name:   "advertised",
+			status: http.StatusOK,
+			body:   `{"maxLength":400000,"keyLength":10}`,
+			want:   400000,
+		},
+		{
+			name:   "not advertised",
+			status: http.StatusOK,
+			body:   `{"keyLength":10}`,
+		},
+		{
+			name:   "invalid json",
+			status: http.StatusOK,
+			body:   "<html></html>",
+		},
+		{
+			name:   "not found",
+			status: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodGet || r.URL.Path != "/config" {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			})
+
+			got, err := c.MaxLength(context.Background())
+			if tt.want == 0 {
+				if err == nil {
+					t.Errorf("expected an error, got %d", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+// blackHoleAddr returns an address that connections time out to, skipping the test if there is
+// none on this network.
+func blackHoleAddr(t *testing.T) string {
+	t.Helper()
+	// 100::/64 is the IPv6 discard prefix, 10.255.255.1 is commonly unrouted.
+	for _, addr := range []string{"[100::1]:80", "10.255.255.1:80"} {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err == nil {
+			_ = conn.Close()
+			continue
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return addr
+		}
+	}
+	t.Skip("no black-hole address available")
+	return ""
+}
+
+func TestClient_Paste_ConnectTimeout(t *testing.T) {
+	c, err := NewClient("http://" + blackHoleAddr(t))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	c.Timeout = time.Minute
+	c.ConnectTimeout = 200 * time.Millisecond
+
+	start := time.Now()
+	_, err = c.Paste(context.Background(), strings.NewReader("hello"))
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the connect timeout to fire before the request timeout, took %s", elapsed)
+	}
+}
+
+func TestClient_Paste_EmptyResponse(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+	}{
+		{
+			name:        "json",
+			contentType: "application/json",
+			status:      http.StatusOK,
+		},
+		{
+			name:   "no content type",
+			status: http.StatusOK,
+		},
+		{
+			name:        "created",
+			contentType: "application/json",
+			status:      http.StatusCreated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.WriteHeader(tt.status)
+			})
+
+			_, err := c.Paste(context.Background(), strings.NewReader("hello"))
+			if !errors.Is(err, ErrEmptyResponse) {
+				t.Errorf("expected ErrEmptyResponse, got %v", err)
+			}
+		})
+	}
+}
+
+func TestClient_Paste_EmptyResponseLocation(t *testing.T) {
+	// An empty body is fine if the haste-server says where the document is.
+	c := newTestClient(t, func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Location", "/abc")
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	res, err := c.Paste(context.Background(), strings.NewReader("hello"))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Key != "abc" {
+		t.Errorf("expected key %q, got %q", "abc", res.Key)
+	}
+}
@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+// Package logctx attaches log attributes to a context, so they are included in every record
+// logged using that context.
+package logctx
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+)
+
+// attrsKey is the context key for attrs.
+type attrsKey struct{}
+
+// attrs are the log attributes attached to a context.
+type attrs struct {
+	mu    sync.RWMutex
+	attrs []slog.Attr
+}
+
+// With returns a copy of ctx with attrs attached, in addition to any attributes already attached
+// to ctx.
+func With(ctx context.Context, as ...slog.Attr) context.Context {
+	a := &attrs{}
+	if parent, ok := ctx.Value(attrsKey{}).(*attrs); ok {
+		a.attrs = parent.get()
+	}
+	for _, attr := range as {
+		a.set(attr)
+	}
+	return context.WithValue(ctx, attrsKey{}, a)
+}
+
+// Set replaces the attribute with the same key as attr attached to ctx (or adds it). The
+// attributes are shared with every context derived from the one returned by With (e.g. using
+// context.WithCancel), so they all see the change.
+//
+// Set is a no-op if With was never used to attach attributes to ctx.
+func Set(ctx context.Context, attr slog.Attr) {
+	if a, ok := ctx.Value(attrsKey{}).(*attrs); ok {
+		a.mu.Lock()
+		a.set(attr)
+		a.mu.Unlock()
+	}
+}
+
+// get returns a copy of the attributes.
+func (a *attrs) get() []slog.Attr {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return slices.Clone(a.attrs)
+}
+
+// set replaces or adds attr, a.mu must be held if a is shared.
+func (a *attrs) set(attr slog.Attr) {
+	for i := range a.attrs {
+		if a.attrs[i].Key == attr.Key {
+			a.attrs[i] = attr
+			return
+		}
+	}
+	a.attrs = append(a.attrs, attr)
+}
+
+// Handler is a slog.Handler that adds the attributes attached to a record's context before
+// passing it on to another handler.
+type Handler struct {
+	h slog.Handler
+}
+
+var _ slog.Handler = (*Handler)(nil)
+
+// NewHandler returns a new handler wrapping h.
+func NewHandler(h slog.Handler) *Handler {
+	return &Handler{h: h}
+}
+
+// Enabled satisfies the slog.Handler interface.
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.h.Enabled(ctx, level)
+}
+
+// Handle satisfies the slog.Handler interface.
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	if a, ok := ctx.Value(attrsKey{}).(*attrs); ok {
+		r = r.Clone()
+		r.AddAttrs(a.get()...)
+	}
+	return h.h.Handle(ctx, r)
+}
+
+// WithAttrs satisfies the slog.Handler interface.
+func (h *Handler) WithAttrs(as []slog.Attr) slog.Handler {
+	return &Handler{h: h.h.WithAttrs(as)}
+}
+
+// WithGroup satisfies the slog.Handler interface.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{h: h.h.WithGroup(name)}
+}
@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package logctx
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// newTestLogger returns a logger writing records without a time to buf.
+func newTestLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(NewHandler(slog.NewTextHandler(buf, &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})))
+}
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newTestLogger(&buf)
+
+	ctx := With(context.Background(), slog.String("conn_id", "a"))
+	child, cancel := context.WithCancel(ctx)
+	defer cancel()
+	logger.InfoContext(child, "before")
+
+	// Set is seen by contexts derived from the one returned by With.
+	Set(ctx, slog.String("conn_id", "b"))
+	logger.InfoContext(child, "after")
+
+	// With copies the attributes, so changes to the copy don't affect the parent.
+	nested := With(ctx, slog.String("stage", "upload"))
+	Set(nested, slog.String("conn_id", "c"))
+	logger.InfoContext(nested, "nested")
+	logger.InfoContext(ctx, "parent")
+
+	want := []string{
+		`level=INFO msg=before conn_id=a`,
+		`level=INFO msg=after conn_id=b`,
+		`level=INFO msg=nested conn_id=c stage=upload`,
+		`level=INFO msg=parent conn_id=b`,
+	}
+	if got := strings.Split(strings.TrimSpace(buf.String()), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("expected logs %q, got %q", want, got)
+	}
+}
+
+func TestSet_WithoutAttrs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newTestLogger(&buf)
+
+	// Set is a no-op without With.
+	ctx := context.Background()
+	Set(ctx, slog.String("conn_id", "a"))
+	logger.InfoContext(ctx, "test")
+	if want := "level=INFO msg=test\n"; buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
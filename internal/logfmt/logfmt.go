@@ -0,0 +1,207 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+// Package logfmt provides a slog.Handler that writes records in logfmt.
+package logfmt
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// timeFormat is the format used for the time of a record, matching slog.TextHandler.
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// Handler is a slog.Handler that writes records as canonical logfmt `key=value` pairs.
+//
+// Unlike slog.TextHandler, values are only ever quoted using logfmt's escaping rules and keys
+// are always sanitized so the output can be parsed by strict logfmt parsers.
+type Handler struct {
+	opts slog.HandlerOptions
+
+	// preformatted contains the attributes added using WithAttrs, already encoded.
+	preformatted []byte
+	// groups contains the groups opened using WithGroup, used to prefix keys.
+	groups []string
+
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+var _ slog.Handler = (*Handler)(nil)
+
+// NewHandler returns a new logfmt handler that writes to w.
+func NewHandler(w io.Writer, opts *slog.HandlerOptions) *Handler {
+	h := &Handler{
+		mu: &sync.Mutex{},
+		w:  w,
+	}
+	if opts != nil {
+		h.opts = *opts
+	}
+	return h
+}
+
+// Enabled satisfies the slog.Handler interface.
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	minLevel := slog.LevelInfo
+	if h.opts.Level != nil {
+		minLevel = h.opts.Level.Level()
+	}
+	return level >= minLevel
+}
+
+// Handle satisfies the slog.Handler interface.
+func (h *Handler) Handle(_ context.Context, r slog.Record) error {
+	buf := make([]byte, 0, 256)
+	if !r.Time.IsZero() {
+		buf = h.appendAttr(buf, nil, slog.Time(slog.TimeKey, r.Time))
+	}
+	buf = h.appendAttr(buf, nil, slog.Any(slog.LevelKey, r.Level))
+	buf = h.appendAttr(buf, nil, slog.String(slog.MessageKey, r.Message))
+	buf = append(buf, h.preformatted...)
+	r.Attrs(func(a slog.Attr) bool {
+		buf = h.appendAttr(buf, h.groups, a)
+		return true
+	})
+	// Every attribute is prefixed with a space, trim the one before the first attribute. There
+	// may not be one if ReplaceAttr removed every attribute.
+	if len(buf) > 0 && buf[0] == ' ' {
+		buf = buf[1:]
+	}
+	buf = append(buf, '\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf)
+	return err
+}
+
+// WithAttrs satisfies the slog.Handler interface.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+	h2 := h.clone()
+	for _, a := range attrs {
+		h2.preformatted = h2.appendAttr(h2.preformatted, h2.groups, a)
+	}
+	return h2
+}
+
+// WithGroup satisfies the slog.Handler interface.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	h2 := h.clone()
+	h2.groups = append(h2.groups, name)
+	return h2
+}
+
+// clone returns a copy of the handler that shares the same writer and lock.
+func (h *Handler) clone() *Handler {
+	h2 := *h
+	h2.preformatted = append([]byte(nil), h.preformatted...)
+	h2.groups = append([]string(nil), h.groups...)
+	return &h2
+}
+
+// appendAttr appends an attribute to buf, prefixing its key with any groups.
+func (h *Handler) appendAttr(buf []byte, groups []string, a slog.Attr) []byte {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() != slog.KindGroup && h.opts.ReplaceAttr != nil {
+		a = h.opts.ReplaceAttr(groups, a)
+		a.Value = a.Value.Resolve()
+	}
+	if a.Equal(slog.Attr{}) {
+		return buf
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		if len(attrs) == 0 {
+			return buf
+		}
+		// Groups with an empty key are inlined.
+		if a.Key != "" {
+			groups = append(groups[:len(groups):len(groups)], a.Key)
+		}
+		for _, ga := range attrs {
+			buf = h.appendAttr(buf, groups, ga)
+		}
+		return buf
+	}
+
+	buf = append(buf, ' ')
+	for _, g := range groups {
+		buf = appendKey(buf, g)
+		buf = append(buf, '.')
+	}
+	buf = appendKey(buf, a.Key)
+	buf = append(buf, '=')
+	buf = appendValue(buf, a.Value)
+	return buf
+}
+
+// appendKey appends a key to buf, replacing any characters that are not allowed in a logfmt key.
+func appendKey(buf []byte, key string) []byte {
+	if key == "" {
+		return append(buf, '_')
+	}
+	for _, r := range key {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || unicode.IsSpace(r) {
+			r = '_'
+		}
+		buf = utf8.AppendRune(buf, r)
+	}
+	return buf
+}
+
+// appendValue appends a value to buf, quoting it if required.
+func appendValue(buf []byte, v slog.Value) []byte {
+	var s string
+	switch v.Kind() {
+	case slog.KindString:
+		s = v.String()
+	case slog.KindTime:
+		s = v.Time().Format(timeFormat)
+	case slog.KindDuration:
+		s = v.Duration().String()
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			s = x.Error()
+		case fmt.Stringer:
+			s = x.String()
+		case []byte:
+			s = string(x)
+		default:
+			s = fmt.Sprint(x)
+		}
+	default:
+		s = v.String()
+	}
+
+	if needsQuoting(s) {
+		return strconv.AppendQuote(buf, s)
+	}
+	return append(buf, s...)
+}
+
+// needsQuoting returns true if s must be quoted to be a valid logfmt value.
+func needsQuoting(s string) bool {
+	if s == "" {
+		return true
+	}
+	return strings.IndexFunc(s, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == '\\' || r == utf8.RuneError || !unicode.IsPrint(r)
+	}) >= 0
+}
@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package logfmt
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := NewHandler(&buf, &slog.HandlerOptions{
+		// Remove the time so the output is deterministic.
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	logger := slog.New(h).With(slog.Int("instance", 1)).WithGroup("conn")
+	logger.Info(
+		"new connection",
+		slog.String("remote_addr", "192.0.2.1:1234"),
+		slog.String("quoted", `say "hi"`),
+		slog.String("empty", ""),
+		slog.String("bad key", "a=b"),
+		slog.Duration("took", 1500*time.Millisecond),
+		slog.Any("err", errors.New("failed\nbadly")),
+		slog.Group("stats", slog.Int("reads", 2)),
+	)
+
+	want := `level=INFO msg="new connection" instance=1 conn.remote_addr=192.0.2.1:1234 ` +
+		`conn.quoted="say \"hi\"" conn.empty="" conn.bad_key="a=b" conn.took=1.5s ` +
+		`conn.err="failed\nbadly" conn.stats.reads=2` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestHandler_Level(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewHandler(&buf, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	logger.Info("hidden")
+	logger.Warn("shown")
+	if !bytes.Contains(buf.Bytes(), []byte("msg=shown")) || bytes.Contains(buf.Bytes(), []byte("hidden")) {
+		t.Errorf("expected only the warning to be logged, got %q", buf.String())
+	}
+}
+
+func TestHandler_AllAttrsRemoved(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(NewHandler(&buf, &slog.HandlerOptions{
+		ReplaceAttr: func([]string, slog.Attr) slog.Attr {
+			return slog.Attr{}
+		},
+	}))
+	logger.Info("first", slog.Int("n", 1))
+	logger.Info("second")
+
+	if want := "\n\n"; buf.String() != want {
+		t.Errorf("expected %q, got %q", want, buf.String())
+	}
+}
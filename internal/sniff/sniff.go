@@ -0,0 +1,126 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+// Package sniff provides simple heuristics for detecting the language of a paste.
+package sniff
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// MaxLength is the maximum number of bytes at the start (and end) of content that are looked at
+// when sniffing, this bounds the cost of sniffing regardless of the size of the content.
+const MaxLength = 512
+
+// Extension returns the file extension (without a leading dot) for the detected language of
+// content, or fallback if the language could not be detected.
+//
+// The heuristics used are intentionally simple and deterministic, they only look at how the
+// content starts (and for JSON, how it ends).
+func Extension(content []byte, fallback string) string {
+	if ext := extension(content); ext != "" {
+		return ext
+	}
+	return fallback
+}
+
+// extension returns the file extension for the detected language of content, or an empty
+// string if the language could not be detected.
+func extension(content []byte) string {
+	trimmed := bytes.TrimLeftFunc(content, unicode.IsSpace)
+	if len(trimmed) < 1 {
+		return ""
+	}
+	head := trimmed[:min(len(trimmed), MaxLength)]
+	tail := bytes.TrimRightFunc(trimmed[max(0, len(trimmed)-MaxLength):], unicode.IsSpace)
+	if len(tail) < 1 {
+		// The content is made up of a short prefix followed by a lot of whitespace.
+		tail = bytes.TrimRightFunc(head, unicode.IsSpace)
+	}
+
+	// Shebangs
+	if bytes.HasPrefix(head, []byte("#!")) {
+		line, _, _ := bytes.Cut(head, []byte{'\n'})
+		switch {
+		case bytes.Contains(line, []byte("python")):
+			return "py"
+		case bytes.Contains(line, []byte("node")):
+			return "js"
+		case bytes.Contains(line, []byte("ruby")):
+			return "rb"
+		case bytes.Contains(line, []byte("perl")):
+			return "pl"
+		default:
+			return "sh"
+		}
+	}
+
+	// JSON
+	switch first, last := head[0], tail[len(tail)-1]; {
+	case first == '{' && last == '}', first == '[' && last == ']':
+		return "json"
+	}
+
+	for _, p := range prefixes {
+		if hasPrefixFold(head, p.prefix) {
+			return p.ext
+		}
+	}
+	return ""
+}
+
+// prefixes maps the prefix of content to an extension.
+var prefixes = []struct {
+	prefix string
+	ext    string
+}{
+	{prefix: "<?xml", ext: "xml"},
+	{prefix: "<!doctype html", ext: "html"},
+	{prefix: "<html", ext: "html"},
+	{prefix: "diff --git ", ext: "diff"},
+	{prefix: "--- a/", ext: "diff"},
+	{prefix: "package ", ext: "go"},
+	{prefix: "<?php", ext: "php"},
+	{prefix: "---\n", ext: "yaml"},
+	{prefix: "# ", ext: "md"},
+}
+
+// hasPrefixFold returns true if b begins with prefix, ignoring case.
+func hasPrefixFold(b []byte, prefix string) bool {
+	return len(b) >= len(prefix) && bytes.EqualFold(b[:len(prefix)], []byte(prefix))
+}
+
+// ContentType returns the media type of content, without any parameters (e.g. `charset`).
+//
+// Detection is done by http.DetectContentType, except for JSON which it reports as plain text.
+func ContentType(content []byte) string {
+	if extension(content) == "json" {
+		return "application/json"
+	}
+	mediaType, _, _ := strings.Cut(http.DetectContentType(content), ";")
+	return mediaType
+}
+
+// MatchContentType returns true if contentType matches any of the patterns. A pattern is either
+// a media type (e.g. `text/plain`) or a media type with a wildcard subtype (e.g. `text/*`).
+//
+// Media types are case-insensitive, so both forms of pattern are matched case-insensitively.
+func MatchContentType(contentType string, patterns []string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if typ, ok := strings.CutSuffix(p, "/*"); ok {
+			if strings.HasPrefix(contentType, typ+"/") {
+				return true
+			}
+			continue
+		}
+		if p == contentType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,122 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package sniff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtension(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"python shebang", "#!/usr/bin/env python3\nprint('hi')", "py"},
+		{"shell shebang", "#!/bin/bash\necho hi", "sh"},
+		{"json object", "{\n  \"a\": 1\n}\n", "json"},
+		{"json array", "  [1, 2, 3]", "json"},
+		{"go", "package main\n\nfunc main() {}", "go"},
+		{"html", "<!DOCTYPE html>\n<html></html>", "html"},
+		{"diff", "diff --git a/main.go b/main.go\n", "diff"},
+		{"yaml", "---\nkey: value\n", "yaml"},
+		{"markdown", "# Title\n\nText", "md"},
+		{"plain text", "hello world", "txt"},
+		{"empty", "", "txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Extension([]byte(tt.content), "txt"); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestExtension_Fallback(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"plain text", "hello world"},
+		{"binary", "\x00\x01\x02\xff"},
+		{"unterminated json", "{\"a\": 1"},
+		{"whitespace", " \n\t "},
+		// The language is only detected from the start of the content.
+		{"past max length", strings.Repeat("a", MaxLength) + "\npackage main\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, fallback := range []string{"", "log"} {
+				if got := Extension([]byte(tt.content), fallback); got != fallback {
+					t.Errorf("expected %q, got %q", fallback, got)
+				}
+			}
+		})
+	}
+}
+
+func TestExtension_Bounded(t *testing.T) {
+	// Only the start and end of the content are looked at, no matter what is in between.
+	content := "{" + strings.Repeat("\x00", 1024*1024) + "}"
+	for range 3 {
+		if got := Extension([]byte(content), "txt"); got != "json" {
+			t.Errorf("expected %q, got %q", "json", got)
+		}
+	}
+}
+
+func TestContentType(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"text", "hello world", "text/plain"},
+		{"json", `{"a": 1}`, "application/json"},
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{"html", "<!DOCTYPE html><html></html>", "text/html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ContentType([]byte(tt.content)); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMatchContentType(t *testing.T) {
+	patterns := []string{"text/*", "application/json"}
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/plain", true},
+		{"text/html", true},
+		{"application/json", true},
+		{"image/png", false},
+		{"textual/plain", false},
+		{"Text/Plain", true},
+		{"Application/JSON", true},
+	}
+	for _, tt := range tests {
+		if got := MatchContentType(tt.contentType, patterns); got != tt.want {
+			t.Errorf("expected %t for %q, got %t", tt.want, tt.contentType, got)
+		}
+	}
+}
+
+func TestMatchContentType_MixedCasePattern(t *testing.T) {
+	patterns := []string{"Text/*", "Application/Json"}
+	for _, contentType := range []string{"text/plain", "TEXT/html", "application/json"} {
+		if !MatchContentType(contentType, patterns) {
+			t.Errorf("expected %q to match %q", contentType, patterns)
+		}
+	}
+	if MatchContentType("image/png", patterns) {
+		t.Errorf("expected %q not to match %q", "image/png", patterns)
+	}
+}
@@ -23,3 +23,24 @@ func Listeners() ([]net.Listener, error) {
 	}
 	return listeners, nil
 }
+
+// ListenersWithNames returns a map of the listeners passed to this process, keyed by the name
+// of their file descriptor (`FileDescriptorName` in the socket unit).
+//
+// Multiple sockets may share the same name, in which case all of them are included in the
+// order they were passed. File descriptors that aren't listening sockets are skipped.
+func ListenersWithNames() (map[string][]net.Listener, error) {
+	files := Files()
+	listeners := make(map[string][]net.Listener, len(files))
+
+	for _, f := range files {
+		// The listener uses its own copy of the file descriptor, so the file is closed either
+		// way, otherwise file descriptors that aren't listening sockets would be leaked.
+		pc, err := net.FileListener(f)
+		_ = f.Close()
+		if err == nil {
+			listeners[f.Name()] = append(listeners[f.Name()], pc)
+		}
+	}
+	return listeners, nil
+}
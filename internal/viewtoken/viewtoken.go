@@ -0,0 +1,33 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+// Package viewtoken generates short-lived signed tokens that allow viewing a paste.
+//
+// A token has the format `<expiry>.<signature>`, where expiry is a Unix timestamp in seconds and
+// signature is the unpadded base64url encoded HMAC-SHA256 of `<key>.<expiry>` using a secret
+// shared with the haste-server.
+package viewtoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"time"
+)
+
+// QueryParam is the name of the query parameter tokens are passed in.
+const QueryParam = "token"
+
+// Generate returns a token allowing the paste with the provided key to be viewed until expires.
+func Generate(secret []byte, key string, expires time.Time) string {
+	expiry := strconv.FormatInt(expires.Unix(), 10)
+	return expiry + "." + sign(secret, key, expiry)
+}
+
+// sign returns the signature for the paste with the provided key and expiry.
+func sign(secret []byte, key, expiry string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key + "." + expiry))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package viewtoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerate(t *testing.T) {
+	secret := []byte("secret")
+	expires := time.Unix(1700000000, 0)
+
+	token := Generate(secret, "abc", expires)
+	expiry, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		t.Fatalf("expected a token of the form <expiry>.<signature>, got %q", token)
+	}
+	if expiry != "1700000000" {
+		t.Errorf("expected the expiry to be encoded as %q, got %q", "1700000000", expiry)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("abc.1700000000"))
+	if want := base64.RawURLEncoding.EncodeToString(mac.Sum(nil)); signature != want {
+		t.Errorf("expected signature %q, got %q", want, signature)
+	}
+
+	// The signature covers the key, expiry and secret.
+	for name, other := range map[string]string{
+		"key":    Generate(secret, "abd", expires),
+		"expiry": Generate(secret, "abc", expires.Add(time.Second)),
+		"secret": Generate([]byte("other"), "abc", expires),
+	} {
+		if _, s, _ := strings.Cut(other, "."); s == signature {
+			t.Errorf("expected a different %s to change the signature", name)
+		}
+	}
+}
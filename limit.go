@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strconv"
+
+	"github.com/alecthomas/kong"
+	"github.com/matthewpi/fiche/internal/haste"
+)
+
+const (
+	// autoLimit is the value of `CLI.Limit` when `--limit=auto` is used.
+	autoLimit = -1
+	// defaultLimit is used when `--limit=auto` is used but the haste-server doesn't advertise its
+	// maximum document size.
+	defaultLimit = 128 * 1024
+)
+
+// limitMapper is a kong.Mapper for `--limit`, accepting `auto` in addition to a number of bytes.
+func limitMapper() kong.MapperFunc {
+	return func(ctx *kong.DecodeContext, target reflect.Value) error {
+		var value string
+		if err := ctx.Scan.PopValueInto("limit", &value); err != nil {
+			return err
+		}
+		if value == "auto" {
+			target.SetInt(autoLimit)
+			return nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("expected a number of bytes or \"auto\" but got %q", value)
+		}
+		target.SetInt(int64(n))
+		return nil
+	}
+}
+
+// resolveLimit returns the limit to use, querying the haste-server for its advertised maximum
+// document size when `--limit=auto` is used.
+func resolveLimit(ctx context.Context, h *haste.Client, limit int) int {
+	if limit != autoLimit {
+		return limit
+	}
+
+	maxLength, err := h.MaxLength(ctx)
+	if err != nil {
+		slog.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"failed to get maximum document size from haste-server, using default limit",
+			slog.Int("limit", defaultLimit),
+			slog.Any("err", err),
+		)
+		return defaultLimit
+	}
+	slog.LogAttrs(ctx, slog.LevelInfo, "using maximum document size advertised by haste-server", slog.Int("limit", maxLength))
+	return maxLength
+}
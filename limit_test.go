@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/matthewpi/fiche/internal/haste"
+)
+
+func TestLimitMapper(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+		valid bool
+	}{
+		{value: "auto", want: autoLimit, valid: true},
+		{value: "1024", want: 1024, valid: true},
+		{value: "0", want: 0, valid: true},
+		{value: "-1"},
+		{value: "1k"},
+	}
+	for _, tt := range tests {
+		err := parseFlags(t, "--limit="+tt.value)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("expected %q to be rejected", tt.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tt.value, err)
+			continue
+		}
+		if CLI.Limit != tt.want {
+			t.Errorf("expected a limit of %d for %q, got %d", tt.want, tt.value, CLI.Limit)
+		}
+	}
+}
+
+func TestResolveLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		body  string
+		want  int
+	}{
+		{
+			name:  "fixed",
+			limit: 1024,
+			body:  `{"maxLength":400000}`,
+			want:  1024,
+		},
+		{
+			name:  "advertised",
+			limit: autoLimit,
+			body:  `{"maxLength":400000}`,
+			want:  400000,
+		},
+		{
+			name:  "not advertised",
+			limit: autoLimit,
+			body:  `{}`,
+			want:  defaultLimit,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			t.Cleanup(srv.Close)
+			h, err := haste.NewClient(srv.URL)
+			if err != nil {
+				t.Fatalf("failed to create haste client: %v", err)
+			}
+
+			if got := resolveLimit(context.Background(), h, tt.limit); got != tt.want {
+				t.Errorf("expected a limit of %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,37 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"runtime"
+	runtimemetrics "runtime/metrics"
+)
+
+// heapObjectsMetric is the runtime metric for the memory occupied by live and unswept objects.
+const heapObjectsMetric = "/memory/classes/heap/objects:bytes"
+
+// overloaded returns the name of the load threshold (if any) that has been reached, in which case
+// new connections should be rejected rather than handled.
+func (s *Server) overloaded() string {
+	if CLI.ShedConnections > 0 && s.metrics.activeConnections.Load() >= int64(CLI.ShedConnections) {
+		return "connections"
+	}
+	if CLI.ShedGoroutines > 0 && runtime.NumGoroutine() >= CLI.ShedGoroutines {
+		return "goroutines"
+	}
+	if CLI.ShedMemory > 0 && heapBytes() >= uint64(CLI.ShedMemory) {
+		return "memory"
+	}
+	return ""
+}
+
+// heapBytes returns the number of bytes occupied by objects on the heap.
+func heapBytes() uint64 {
+	sample := []runtimemetrics.Sample{{Name: heapObjectsMetric}}
+	runtimemetrics.Read(sample)
+	if sample[0].Value.Kind() != runtimemetrics.KindUint64 {
+		return 0
+	}
+	return sample[0].Value.Uint64()
+}
@@ -0,0 +1,117 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOverloaded(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		active int64
+		want   string
+	}{
+		{
+			name:   "disabled",
+			active: 1000,
+		},
+		{
+			name:   "connections under threshold",
+			args:   []string{"--shed-connections=2"},
+			active: 1,
+		},
+		{
+			name:   "connections",
+			args:   []string{"--shed-connections=2"},
+			active: 2,
+			want:   "connections",
+		},
+		{
+			name: "goroutines",
+			args: []string{"--shed-goroutines=1"},
+			want: "goroutines",
+		},
+		{
+			name: "goroutines under threshold",
+			args: []string{"--shed-goroutines=1000000"},
+		},
+		{
+			name: "memory",
+			args: []string{"--shed-memory=1"},
+			want: "memory",
+		},
+		{
+			name: "memory under threshold",
+			args: []string{"--shed-memory=1099511627776"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			s := NewServer(nil, nil)
+			s.metrics.activeConnections.Store(tt.active)
+			if got := s.overloaded(); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRun_ShedConnections(t *testing.T) {
+	setFlags(t, "--shed-connections=1", "--read-timeout=5s")
+	s, _ := newTestServer(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s.listener = l
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run(ctx)
+	}()
+
+	// Keep a connection active, so the server is over the threshold.
+	active, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer active.Close()
+	for s.metrics.activeConnections.Load() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	res, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if want := "Server is busy, please try again later\n"; string(res) != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+	if n := s.metricsSnapshot().Rejections; n != 1 {
+		t.Errorf("expected 1 rejection, got %d", n)
+	}
+
+	_ = active.Close()
+	cancel()
+	_ = l.Close()
+	<-runErr
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shutdown: %v", err)
+	}
+}
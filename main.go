@@ -4,67 +4,309 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"os"
-	"os/signal"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/matthewpi/fiche/internal/haste"
+	"github.com/matthewpi/fiche/internal/logctx"
+	"github.com/matthewpi/fiche/internal/logfmt"
 	"github.com/matthewpi/fiche/internal/systemd"
 )
 
 var CLI struct {
 	Listen   string `help:"Listen address" default:":99"`
 	Hastebin string `help:"haste-server URL" placeholder:"https://ptero.co"`
-	Limit    int    `help:"Maximum size per paste" default:"131072"` // 131072 = 128 * 1024 (128 KiB)
+	Limit    int    `help:"Maximum size per paste in bytes (inclusive), or auto to use the haste-server's maximum" default:"131072" type:"limit"` // 131072 = 128 * 1024 (128 KiB)
+
+	ReadBufferSize     int           `help:"Maximum amount of data to read from a connection at once (up to 65536)" default:"1024"`
+	MaxReadsPerConn    int           `help:"Close connections that take more than this many reads to send a paste (0 for no limit)" default:"0"`
+	HardReadCap        int64         `help:"Kill connections after reading this many bytes regardless of the limit, as a safety net (0 to disable)" default:"0"`
+	SpillToDisk        int           `help:"Buffer pastes larger than this many bytes in a temporary file instead of memory (0 to disable)" default:"0"`
+	SpillDir           string        `help:"Directory for temporary files when using --spill-to-disk, defaults to the system's temporary directory" type:"path"`
+	ReadTimeout        time.Duration `help:"Time to wait for more data before considering a paste complete" default:"2s"`
+	FirstByteTimeout   time.Duration `help:"Time to wait for the first data from a client, defaults to --read-timeout" default:"0"`
+	ResetAction        string        `help:"What to do with a partially received paste when the client resets the connection" enum:"upload,discard" default:"upload"`
+	ReadCoalesce       time.Duration `help:"Wait this long after a partial read for more data to arrive, reducing reads for fragmented streams (e.g. 10ms)" default:"0"`
+	AdaptiveTimeout    bool          `help:"Scale the read timeout based on the throughput of the client"`
+	AdaptiveTimeoutMin time.Duration `help:"Minimum read timeout when using --adaptive-timeout" default:"1s"`
+	AdaptiveTimeoutMax time.Duration `help:"Maximum read timeout when using --adaptive-timeout" default:"10s"`
+
+	RejectionLogInterval time.Duration `help:"How often to log rejected connections by network prefix (0 to disable)" default:"0"`
+	RejectionLogTop      int           `help:"Number of network prefixes to include when logging rejections" default:"10"`
+
+	ViewTokenSecret string        `help:"Secret used to sign view tokens appended to returned URLs" env:"FICHE_VIEW_TOKEN_SECRET"`
+	ViewTokenTTL    time.Duration `help:"How long view tokens are valid for" default:"24h" name:"view-token-ttl"`
+
+	ResponseDelay           time.Duration `help:"Wait this long before responding to a client" default:"0"`
+	ResponseDelayScale      bool          `help:"Multiply --response-delay by the number of requests from the client in the last minute"`
+	ResponseDelayMax        time.Duration `help:"Maximum response delay when using --response-delay-scale" default:"10s"`
+	UsageMessage            string        `help:"Message sent to clients that connect without sending anything, e.g. a usage example"`
+	Identify                bool          `help:"Prepend a '# fiche <version>' line to responses"`
+	ClientSideEncrypt       bool          `help:"Encrypt pastes before uploading them, returning the key in the URL fragment"`
+	AutoExtension           bool          `help:"Append a file extension to the URL based on the detected language of the paste"`
+	SniffDefault            string        `help:"File extension to use when --auto-extension can't detect the language (e.g. txt)"`
+	ResponseWriteRetries    int           `help:"Number of times to retry writing a response that timed out, within a single 1s deadline" default:"2"`
+	ResponseTrailingNewline bool          `help:"End the response with a newline" default:"true" negatable:""`
+	Links                   []string      `help:"Respond with a labeled line for each of these link formats instead of a single URL" enum:"viewer,raw,download" placeholder:"viewer,raw,download"`
+
+	MaxTotalPastes   int64 `help:"Maximum number of pastes to accept before refusing new ones (0 for no limit)" default:"0"`
+	ShutdownAfterMax bool  `help:"Gracefully shut down once --max-total-pastes has been reached"`
+
+	SplitLarge        bool `help:"Split large pastes into multiple documents instead of enforcing --limit"`
+	SplitSize         int  `help:"Maximum size per document when using --split-large" default:"131072"`
+	SplitMaxDocuments int  `help:"Maximum number of documents a paste may be split into" default:"8"`
+
+	BatchDelimiter    string `help:"Upload pastes as separate documents, split on lines consisting only of this delimiter (e.g. ---)"`
+	BatchMaxDocuments int    `help:"Maximum number of documents in a batch when using --batch-delimiter" default:"8"`
+
+	RequirePTR  bool          `help:"Reject clients without a reverse DNS (PTR) record, this is a crude heuristic" name:"require-ptr"`
+	PTRTimeout  time.Duration `help:"Timeout for reverse DNS lookups" default:"2s" name:"ptr-timeout"`
+	PTRCacheTTL time.Duration `help:"How long to cache reverse DNS lookups for" default:"10m" name:"ptr-cache-ttl"`
+
+	TorBlock        string        `help:"File or http(s) URL of a list of Tor exit node addresses to reject (or log) connections from"`
+	TorBlockAction  string        `help:"Action to take for connections from Tor exit nodes" enum:"reject,log" default:"reject"`
+	TorBlockRefresh time.Duration `help:"How often to reload the list of Tor exit nodes" default:"1h"`
+
+	StripANSI bool `help:"Remove ANSI escape sequences (e.g. colors) from pastes" name:"strip-ansi"`
+
+	AllowedContentTypes []string `help:"Only allow pastes with these detected content types (e.g. text/*,application/json)"`
+
+	AllowCustomKeys     bool `help:"Allow clients to request a custom key using a leading '!key <key>' line"`
+	AllowFilename       bool `help:"Allow clients to send a filename using a leading '!filename <name>' line, its extension is used for syntax highlighting"`
+	AcceptClientTraceID bool `help:"Allow clients to send an ID to use for the connection in logs using a leading '!trace-id <id>' line" name:"accept-client-trace-id"`
+	MaxDirectiveLine    int  `help:"Maximum length of a leading directive line, excluding its line ending" default:"1024"`
+	MaxDirectiveValue   int  `help:"Maximum length of the value of a leading directive" default:"256"`
+	MaxDirectives       int  `help:"Maximum number of leading directive lines, any further lines are treated as content" default:"16"`
+
+	AggregateFile string `help:"Append every paste to this file, rotated daily" type:"path"`
+
+	SideEffectWorkers int `help:"Number of workers running background tasks (e.g. --aggregate-file)" default:"4"`
+	SideEffectQueue   int `help:"Maximum number of queued background tasks before new ones are dropped" default:"64"`
+
+	UpstreamMethod           string        `help:"HTTP method used to create pastes" enum:"POST,PUT,PATCH" default:"POST"`
+	UpstreamMaxConcurrent    int           `help:"Maximum concurrent requests to the haste-server (0 for no limit)" default:"0"`
+	MaxUploadsPerIP          int           `help:"Maximum concurrent uploads to the haste-server per client address (0 for no limit)" default:"0" name:"max-uploads-per-ip"`
+	UpstreamErrorLogBytes    int           `help:"Maximum bytes of an upstream error response to log (0 for no limit)" default:"256"`
+	UpstreamErrorRedact      []string      `help:"Regular expressions to redact from logged upstream error responses"`
+	UpstreamTimeout          time.Duration `help:"Timeout for requests to the haste-server (0 to disable)" default:"30s"`
+	UpstreamConnectTimeout   time.Duration `help:"Timeout for connecting to the haste-server (0 to only use --upstream-timeout)" default:"10s"`
+	UpstreamColdStartTimeout time.Duration `help:"Timeout for the first request after the haste-server has been idle (0 to disable)" default:"0"`
+	UpstreamColdStartAfter   time.Duration `help:"Period of inactivity after which the haste-server is considered cold" default:"5m"`
+	VerifyUpload             bool          `help:"Read every paste back from the haste-server and make sure it matches what was sent"`
+	VerifyUploadTimeout      time.Duration `help:"Timeout for reading a paste back when using --verify-upload" default:"5s"`
+
+	LogFormat string `help:"Log format (text, json, logfmt)" enum:"text,json,logfmt" default:"text"`
+	LogLevel  string `help:"Minimum level of logs to write (debug, info, warn, error)" enum:"debug,info,warn,error" default:"info"`
+
+	DiagnosticsOnError bool `help:"Log the timings, byte counts and read sizes of connections that end in an error"`
+
+	LogSourcePort bool `help:"Include the source port of clients in logs" default:"true" negatable:""`
+
+	InstanceIndex int `help:"Index of this instance, included in logs (-1 to disable)" default:"-1"`
+
+	SystemdSocketName string `help:"Only use the systemd socket with this FileDescriptorName"`
+
+	ReuseAddr bool `help:"Set SO_REUSEADDR on the listener" default:"true" negatable:""`
+
+	IdleTimeout       time.Duration `help:"Close connections idle for longer than this, must be greater than the sum of the timeouts and delays a connection may wait on (0 to disable)" default:"0"`
+	IdleSweepInterval time.Duration `help:"How often to check for idle connections" default:"10s"`
+
+	ShedConnections int `help:"Reject new connections while this many connections are active (0 to disable)" default:"0"`
+	ShedGoroutines  int `help:"Reject new connections while this many goroutines are running (0 to disable)" default:"0"`
+	ShedMemory      int `help:"Reject new connections while the heap uses this many bytes (0 to disable)" default:"0"`
+
+	DropPrivileges string `help:"Switch to this user after binding the listener and writing the state files, given as user[:group] names or IDs" placeholder:"USER[:GROUP]"`
+
+	PIDFile   string `help:"Write the process ID to this file once listening" type:"path" name:"pid-file"`
+	ReadyFile string `help:"Write the listen address to this file once listening" type:"path"`
+
+	ShutdownTimeout time.Duration `help:"Maximum time to wait for connections to finish when shutting down" default:"30s"`
 }
 
 func main() {
 	_ = kong.Parse(
 		&CLI,
 		kong.Name("fiche"),
+		kong.NamedMapper("limit", limitMapper()),
 	)
 
-	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{})))
+	slog.SetDefault(newLogger(os.Stderr))
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := notifyShutdown(context.Background())
 	defer cancel()
 
+	// run is the only place that can fail, exiting here ensures all deferred calls in run have
+	// completed (including waiting for in-flight connections) before the process exits.
+	if err := run(ctx); err != nil {
+		slog.LogAttrs(ctx, slog.LevelError, "fatal error", slog.Any("err", err))
+		cancel()
+		os.Exit(1)
+	}
+}
+
+// run runs fiche until the context is canceled, then gracefully shuts down the server.
+func run(ctx context.Context) error {
 	h, err := haste.NewClient(CLI.Hastebin)
 	if err != nil {
-		slog.LogAttrs(ctx, slog.LevelError, "failed to create hastebin client", slog.Any("err", err))
-		os.Exit(1)
-		return
+		return fmt.Errorf("failed to create hastebin client: %w", err)
+	}
+	h.Method = CLI.UpstreamMethod
+	h.MaxConcurrent = CLI.UpstreamMaxConcurrent
+	h.ErrorDataLimit = CLI.UpstreamErrorLogBytes
+	for _, pattern := range CLI.UpstreamErrorRedact {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("failed to compile upstream error redaction pattern: %w", err)
+		}
+		h.ErrorRedact = append(h.ErrorRedact, re)
+	}
+	h.Timeout = CLI.UpstreamTimeout
+	h.ConnectTimeout = CLI.UpstreamConnectTimeout
+	h.ColdStartTimeout = CLI.UpstreamColdStartTimeout
+	h.ColdStartAfter = CLI.UpstreamColdStartAfter
+
+	CLI.Limit = resolveLimit(ctx, h, CLI.Limit)
+	if CLI.SplitLarge && CLI.BatchDelimiter != "" {
+		return errors.New("--split-large can't be used with --batch-delimiter")
+	}
+	if CLI.SpillToDisk > 0 {
+		if conflicts := spillConflicts(); len(conflicts) > 0 {
+			return fmt.Errorf("--spill-to-disk can't be used with %s", strings.Join(conflicts, ", "))
+		}
+	}
+	if CLI.IdleTimeout > 0 && CLI.IdleSweepInterval > 0 {
+		// Requests to the haste-server don't touch the connection, the reaper would close a
+		// connection waiting on one without a timeout.
+		if CLI.UpstreamTimeout <= 0 {
+			return errors.New("--idle-timeout can't be used without --upstream-timeout")
+		}
+		if wait, waits := maxIdleWait(); wait >= CLI.IdleTimeout {
+			return fmt.Errorf("--idle-timeout (%s) must be greater than the longest a connection may be idle for (%s: %s)", CLI.IdleTimeout, wait, strings.Join(waits, " + "))
+		}
+	}
+	if CLI.HardReadCap > 0 && CLI.HardReadCap <= int64(pasteLimit()) {
+		return fmt.Errorf("--hard-read-cap (%d) must be greater than the paste limit (%d)", CLI.HardReadCap, pasteLimit())
 	}
 
 	listener, err := getListener(ctx)
 	if err != nil {
-		slog.LogAttrs(ctx, slog.LevelError, "failed to start listener", slog.Any("err", err))
-		os.Exit(1)
-		return
+		return fmt.Errorf("failed to start listener: %w", err)
 	}
 	defer listener.Close()
 
+	// Let other init systems know we are up and running, now that we are listening.
+	if CLI.PIDFile != "" {
+		defer writeStateFile(ctx, CLI.PIDFile, []byte(strconv.Itoa(os.Getpid())+"\n"))()
+	}
+	if CLI.ReadyFile != "" {
+		defer writeStateFile(ctx, CLI.ReadyFile, []byte(listener.Addr().String()+"\n"))()
+	}
+
+	// Drop privileges now that we've bound the listener (possibly to a privileged port) and
+	// written the state files (possibly to a directory only writable by root, e.g. /run). The
+	// unprivileged user may not be able to remove the state files again on shutdown.
+	if CLI.DropPrivileges != "" {
+		if err := dropPrivileges(ctx, CLI.DropPrivileges); err != nil {
+			return fmt.Errorf("failed to drop privileges: %w", err)
+		}
+	}
+
+	// Allow the server to stop itself (e.g. once --max-total-pastes has been reached).
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
 	slog.LogAttrs(ctx, slog.LevelInfo, "starting server...")
 	s := NewServer(listener, h)
-	go func(ctx context.Context, s *Server) {
-		if err := s.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
-			slog.LogAttrs(ctx, slog.LevelError, "error while running server", slog.Any("err", err))
-			os.Exit(1)
-			return
+	s.stop = stop
+	h.ObserveLatency = s.latency.Observe
+	if CLI.RequirePTR {
+		s.ptr = newPTRChecker(net.DefaultResolver, CLI.PTRTimeout, CLI.PTRCacheTTL)
+	}
+	if CLI.RejectionLogInterval > 0 {
+		s.rejections = newRejectionStats()
+	}
+	if CLI.MaxUploadsPerIP > 0 {
+		s.uploads = newUploadLimiter(CLI.MaxUploadsPerIP)
+	}
+	if CLI.TorBlock != "" {
+		s.tor = newExitList(CLI.TorBlock)
+		if err := s.tor.Load(ctx); err != nil {
+			return err
+		}
+		if CLI.TorBlockRefresh > 0 {
+			go s.tor.Refresh(ctx, CLI.TorBlockRefresh)
 		}
+	}
+	if CLI.AggregateFile != "" {
+		s.aggregate = newAggregator(CLI.AggregateFile)
+		defer s.aggregate.Close()
+	}
+	errCh := make(chan error, 1)
+	go func(ctx context.Context, s *Server) {
+		errCh <- s.Run(ctx)
 	}(ctx, s)
 
-	<-ctx.Done()
+	select {
+	case <-ctx.Done():
+	case err := <-errCh:
+		if err != nil && !errors.Is(err, context.Canceled) {
+			return fmt.Errorf("error while running server: %w", err)
+		}
+	}
+
 	slog.LogAttrs(ctx, slog.LevelInfo, "shutting down...")
+
+	// Stop accepting new connections, then wait for any in-flight connections to finish.
+	_ = listener.Close()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), CLI.ShutdownTimeout)
+	defer shutdownCancel()
+	err = s.Shutdown(shutdownCtx)
+	s.LogLatencySummary(ctx)
+	s.LogMetrics(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to gracefully shutdown server: %w", err)
+	}
+	return nil
+}
+
+// newLogger returns the logger to use, writing logs to w.
+func newLogger(w io.Writer) *slog.Logger {
+	logger := slog.New(logctx.NewHandler(newLogHandler(w, CLI.LogFormat, CLI.LogLevel)))
+	if CLI.InstanceIndex >= 0 {
+		// Include the instance index in every log, so operators running multiple instances on the
+		// same port can see how connections are distributed between them.
+		logger = logger.With(slog.Int("instance", CLI.InstanceIndex))
+	}
+	return logger
+}
+
+// newLogHandler returns the slog.Handler to use for the given log format and minimum level,
+// writing logs to w.
+func newLogHandler(w io.Writer, format, level string) slog.Handler {
+	var l slog.Level
+	// The level has already been validated by kong.
+	_ = l.UnmarshalText([]byte(level))
+	opts := &slog.HandlerOptions{Level: l}
+	switch format {
+	case "json":
+		return slog.NewJSONHandler(w, opts)
+	case "logfmt":
+		return logfmt.NewHandler(w, opts)
+	default:
+		return slog.NewTextHandler(w, opts)
+	}
 }
 
 // getListener returns the net.Listener to listen on.
@@ -75,125 +317,68 @@ func main() {
 // If we are not running with a systemd socket activation, we will bind to the address set by
 // `CLI.Listen`.
 func getListener(ctx context.Context) (net.Listener, error) {
+	if CLI.SystemdSocketName != "" {
+		return getNamedListener(CLI.SystemdSocketName)
+	}
+
 	listeners, err := systemd.Listeners()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get systemd listeners: %w", err)
 	}
-	if len(listeners) == 1 {
+	// File descriptors that aren't listening sockets (e.g. a datagram socket) are nil.
+	passed := len(listeners)
+	listeners = slices.DeleteFunc(listeners, func(l net.Listener) bool { return l == nil })
+	switch {
+	case len(listeners) == 1:
 		return listeners[0], nil
+	case len(listeners) > 1:
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+		return nil, fmt.Errorf("%d systemd sockets were passed to the process, use --systemd-socket-name to select one", len(listeners))
+	case passed > 0:
+		return nil, fmt.Errorf("none of the %d file descriptors passed by systemd are listening stream sockets", passed)
 	}
-	return (&net.ListenConfig{}).Listen(ctx, "tcp", CLI.Listen)
-}
-
-// Server is responsible for listening for incoming connections, reading data, and forwarding it
-// to a haste-server.
-type Server struct {
-	listener net.Listener
-	haste    *haste.Client
-}
 
-// NewServer returns a new server using the provided listener and haste-server client.
-func NewServer(l net.Listener, h *haste.Client) *Server {
-	return &Server{
-		listener: l,
-		haste:    h,
+	// An empty address would make us listen on a random port, which nobody could connect to.
+	if CLI.Listen == "" {
+		return nil, errors.New("no listen address configured and no systemd sockets provided")
 	}
-}
 
-// Run runs the server, listening for incoming connections on the server's listener.
-func (s *Server) Run(ctx context.Context) error {
-	slog.LogAttrs(ctx, slog.LevelInfo, "listening for incoming connections...")
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		default:
-			conn, err := s.listener.Accept()
-			if err != nil {
-				// Ignore `use of closed network connection` errors, these are triggered when the
-				// server is shutting down.
-				if strings.HasSuffix(err.Error(), "use of closed network connection") {
-					break
-				}
-				slog.LogAttrs(ctx, slog.LevelWarn, "error while accepting connection", slog.Any("err", err))
-				break
-			}
-
-			// Handle the connection in the background.
-			go func(ctx context.Context, conn net.Conn) {
-				if err := s.handle(ctx, conn); err != nil {
-					slog.LogAttrs(ctx, slog.LevelWarn, "error while handling connection", slog.Any("err", err))
-				}
-			}(ctx, conn)
-		}
+	lc := &net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			return setReuseAddr(c, CLI.ReuseAddr)
+		},
 	}
+	return lc.Listen(ctx, "tcp", CLI.Listen)
 }
 
-// handle handles an incoming connection from the listener.
-func (s *Server) handle(ctx context.Context, conn net.Conn) error {
-	remoteAddr := conn.RemoteAddr().String()
-	slog.LogAttrs(ctx, slog.LevelInfo, "new connection", slog.Any("remote_addr", remoteAddr))
-	defer slog.LogAttrs(ctx, slog.LevelInfo, "connection closed", slog.Any("remote_addr", remoteAddr))
-	defer conn.Close()
-
-	// buf is all the data read from the connection.
-	var buf bytes.Buffer
-	// tmp is used to read smaller chunks of data from the connection.
-	tmp := make([]byte, 1024)
-	for {
-		// Reset the read deadline on each iteration, this functions as a timeout for each read.
-		if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
-			return fmt.Errorf("failed to set read deadline: %w", err)
-		}
-
-		n, err := conn.Read(tmp)
-		if err != nil {
-			// Normally you would wait for an io.EOF here, but netcat doesn't send an EOF when it's
-			// finished, so we just have to assume that it finished sending data after a timeout
-			// is reached.
-			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				if buf.Len() < 1 {
-					slog.LogAttrs(ctx, slog.LevelInfo, "no data received from client before connection timed out")
-					return nil
-				}
-
-				// Got data from client, break.
-				break
-			}
+// getNamedListener returns the systemd listener with the provided `FileDescriptorName`, any
+// other listeners passed to the process are closed.
+func getNamedListener(name string) (net.Listener, error) {
+	named, err := systemd.ListenersWithNames()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get systemd listeners: %w", err)
+	}
+	for n, listeners := range named {
+		if n == name {
+			continue
 		}
-
-		buf.Write(tmp[:n])
-		if buf.Len() > CLI.Limit {
-			if err := conn.SetWriteDeadline(time.Now().Add(1 * time.Second)); err != nil {
-				return fmt.Errorf("failed to set write deadline: %w", err)
-			}
-			// TODO: it would be nice if we could pretty print the limit rather than always sending
-			// it as the number of bytes.
-			_, err = conn.Write([]byte("Pastes may not exceed " + strconv.Itoa(CLI.Limit) + " bytes of data"))
-			return err
+		for _, l := range listeners {
+			_ = l.Close()
 		}
 	}
 
-	// Send the data to the haste-server.
-	r, err := s.haste.Paste(ctx, &buf)
-	if err != nil {
-		return fmt.Errorf("failed to forward data to hastebin: %w", err)
-	}
-
-	// Stupidly, but efficiently do byte slice copies to combine the URL and Key into a single
-	// URL to write back to the client.
-	url := []byte(s.haste.URL)
-	key := []byte(r.Key)
-	res := make([]byte, len(url)+len(key)+2)
-	n := copy(res, url)
-	res[n] = '/'
-	n++
-	n += copy(res[n:], key)
-	res[n] = '\n'
-
-	if err := conn.SetWriteDeadline(time.Now().Add(1 * time.Second)); err != nil {
-		return fmt.Errorf("failed to set write deadline: %w", err)
+	listeners := named[name]
+	switch len(listeners) {
+	case 0:
+		return nil, fmt.Errorf("no systemd socket named %q was passed to the process", name)
+	case 1:
+		return listeners[0], nil
+	default:
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+		return nil, fmt.Errorf("%d systemd sockets named %q were passed to the process, only one may be used", len(listeners), name)
 	}
-	_, err = conn.Write(res)
-	return err
 }
@@ -0,0 +1,160 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// captureLogs replaces the default logger with one writing to the returned buffer, restoring the
+// original logger once the test has finished.
+func captureLogs(t *testing.T) *syncBuffer {
+	t.Helper()
+	buf := &syncBuffer{}
+	logger := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(logger) })
+	slog.SetDefault(newLogger(buf))
+	return buf
+}
+
+func TestNewLogger_InstanceIndex(t *testing.T) {
+	setFlags(t, "--instance-index=3", "--log-format=json")
+	logs := captureLogs(t)
+
+	s, _ := newTestServer(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s.listener = l
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run(ctx)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+
+	cancel()
+	_ = l.Close()
+	<-runErr
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shutdown: %v", err)
+	}
+
+	messages := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry struct {
+			Msg      string `json:"msg"`
+			Instance *int   `json:"instance"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("failed to decode log %q: %v", line, err)
+		}
+		if entry.Instance == nil || *entry.Instance != 3 {
+			t.Errorf("expected log %q to include the instance index", line)
+		}
+		messages[entry.Msg] = true
+	}
+	for _, msg := range []string{"listening for incoming connections...", "new connection"} {
+		if !messages[msg] {
+			t.Errorf("expected a %q log", msg)
+		}
+	}
+}
+
+func TestNewLogger_NoInstanceIndex(t *testing.T) {
+	setFlags(t, "--log-format=json")
+	var buf bytes.Buffer
+	newLogger(&buf).Info("test")
+	if strings.Contains(buf.String(), "instance") {
+		t.Errorf("expected no instance index, got %q", buf.String())
+	}
+}
+
+func TestUpstreamMethod(t *testing.T) {
+	tests := []struct {
+		args  []string
+		want  string
+		valid bool
+	}{
+		{args: nil, want: "POST", valid: true},
+		{args: []string{"--upstream-method=PUT"}, want: "PUT", valid: true},
+		{args: []string{"--upstream-method=PATCH"}, want: "PATCH", valid: true},
+		{args: []string{"--upstream-method=GET"}},
+		{args: []string{"--upstream-method=put"}},
+	}
+	for _, tt := range tests {
+		err := parseFlags(t, tt.args...)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("expected %q to be rejected", tt.args)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", tt.args, err)
+			continue
+		}
+		if CLI.UpstreamMethod != tt.want {
+			t.Errorf("expected %q, got %q", tt.want, CLI.UpstreamMethod)
+		}
+	}
+}
+
+func TestGetListener_NoListener(t *testing.T) {
+	// Make sure no systemd sockets are passed to the test, whatever is running it.
+	t.Setenv("LISTEN_PID", "")
+	t.Setenv("LISTEN_FDS", "")
+	setFlags(t, "--listen=")
+
+	l, err := getListener(context.Background())
+	if err == nil {
+		_ = l.Close()
+		t.Fatal("expected an error")
+	}
+	if want := "no listen address configured and no systemd sockets provided"; err.Error() != want {
+		t.Errorf("expected %q, got %q", want, err.Error())
+	}
+}
@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/matthewpi/fiche/internal/systemd"
+)
+
+// systemdCommand returns a command running the named helper test with files passed to it the
+// same way systemd does, named using names.
+func systemdCommand(name string, files []*os.File, names []string) *exec.Cmd {
+	cmd := helperCommand(
+		context.Background(),
+		name,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+	)
+	cmd.ExtraFiles = files
+	return cmd
+}
+
+// setListenPID sets LISTEN_PID to the PID of a helper process, it isn't known until the helper
+// has been started.
+func setListenPID() {
+	_ = os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+}
+
+// listenerFile returns a new TCP listener's address and file.
+func listenerFile(t *testing.T) (string, *os.File) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("failed to get listener file: %v", err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	return l.Addr().String(), f
+}
+
+// packetFile returns the file of a new UDP socket, which isn't a listener.
+func packetFile(t *testing.T) *os.File {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer pc.Close()
+	f, err := pc.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatalf("failed to get socket file: %v", err)
+	}
+	t.Cleanup(func() { _ = f.Close() })
+	return f
+}
+
+// TestListenersWithNamesHelper is a helper test run using helperCommand by the
+// TestListenersWithNames tests.
+//
+// It prints the name and address of every listener returned by systemd.ListenersWithNames,
+// sorted by name, followed by any of the passed file descriptors that were left open.
+func TestListenersWithNamesHelper(t *testing.T) {
+	if !isHelperProcess(t) {
+		return
+	}
+	setListenPID()
+
+	named, err := systemd.ListenersWithNames()
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(1)
+	}
+	names := make([]string, 0, len(named))
+	for name := range named {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, l := range named[name] {
+			fmt.Println(name, l.Addr())
+			_ = l.Close()
+		}
+	}
+	fds, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	for fd := 3; fd < 3+fds; fd++ {
+		var stat syscall.Stat_t
+		if err := syscall.Fstat(fd, &stat); err == nil {
+			fmt.Println("open", fd)
+		}
+	}
+	os.Exit(0)
+}
+
+func TestListenersWithNames_Duplicates(t *testing.T) {
+	addr1, f1 := listenerFile(t)
+	addr2, f2 := listenerFile(t)
+	addr3, f3 := listenerFile(t)
+
+	cmd := systemdCommand("TestListenersWithNamesHelper", []*os.File{f1, f2, f3}, []string{"web", "other", "web"})
+	got := strings.Split(strings.TrimSpace(helperOutput(t, cmd)), "\n")
+	want := []string{"other " + addr2, "web " + addr1, "web " + addr3}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestListenersWithNames_NonStream(t *testing.T) {
+	addr, f := listenerFile(t)
+	udp := packetFile(t)
+
+	// File descriptors that aren't listening sockets are skipped, and closed rather than leaked.
+	cmd := systemdCommand("TestListenersWithNamesHelper", []*os.File{udp, f}, []string{"web", "web"})
+	got := strings.Split(strings.TrimSpace(helperOutput(t, cmd)), "\n")
+	if want := []string{"web " + addr}; !slices.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+// TestGetListenerHelper is a helper test run using helperCommand by TestGetListener_NonStream.
+//
+// It prints the address of the listener returned by getListener, or the error.
+func TestGetListenerHelper(t *testing.T) {
+	if !isHelperProcess(t) {
+		return
+	}
+	setListenPID()
+
+	l, err := getListener(context.Background())
+	if err != nil {
+		fmt.Println("error:", err)
+		os.Exit(0)
+	}
+	fmt.Println("listener:", l.Addr())
+	_ = l.Close()
+	os.Exit(0)
+}
+
+func TestGetListener_NonStream(t *testing.T) {
+	files := []*os.File{packetFile(t), packetFile(t)}
+	for _, n := range []int{1, 2} {
+		t.Run(strconv.Itoa(n), func(t *testing.T) {
+			cmd := systemdCommand("TestGetListenerHelper", files[:n], nil)
+			want := fmt.Sprintf("error: none of the %d file descriptors passed by systemd are listening stream sockets", n)
+			if got := strings.TrimSpace(helperOutput(t, cmd)); got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+		})
+	}
+}
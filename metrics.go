@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// metrics are counters and gauges describing the activity of a server.
+//
+// All fields are updated using atomics, so they are safe to update from any connection.
+type metrics struct {
+	connections       atomic.Uint64
+	activeConnections atomic.Int64
+	pastes            atomic.Uint64
+	bytesUploaded     atomic.Uint64
+	rejections        atomic.Uint64
+	clientErrors      atomic.Uint64
+	internalErrors    atomic.Uint64
+}
+
+// metricsSnapshot is a point-in-time snapshot of the metrics of a server.
+type metricsSnapshot struct {
+	// Connections is the total number of connections accepted.
+	Connections uint64
+	// ActiveConnections is the number of connections currently being handled.
+	ActiveConnections int64
+	// Pastes is the total number of documents uploaded to the haste-server.
+	Pastes uint64
+	// BytesUploaded is the total number of bytes uploaded to the haste-server.
+	BytesUploaded uint64
+	// Rejections is the total number of clients rejected by a policy or limit.
+	Rejections uint64
+	// ClientErrors is the total number of connections that failed due to the client.
+	ClientErrors uint64
+	// InternalErrors is the total number of connections that failed due to fiche or its
+	// upstream.
+	InternalErrors uint64
+}
+
+// metricsSnapshot returns a snapshot of the server's metrics, used by LogMetrics.
+//
+// Each value is loaded individually, so the snapshot may not be consistent across fields while
+// connections are being handled.
+func (s *Server) metricsSnapshot() metricsSnapshot {
+	return metricsSnapshot{
+		Connections:       s.metrics.connections.Load(),
+		ActiveConnections: s.metrics.activeConnections.Load(),
+		Pastes:            s.metrics.pastes.Load(),
+		BytesUploaded:     s.metrics.bytesUploaded.Load(),
+		Rejections:        s.metrics.rejections.Load(),
+		ClientErrors:      s.metrics.clientErrors.Load(),
+		InternalErrors:    s.metrics.internalErrors.Load(),
+	}
+}
+
+// LogMetrics logs a snapshot of the server's metrics.
+func (s *Server) LogMetrics(ctx context.Context) {
+	m := s.metricsSnapshot()
+	slog.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"server metrics",
+		slog.Uint64("connections", m.Connections),
+		slog.Int64("active_connections", m.ActiveConnections),
+		slog.Uint64("pastes", m.Pastes),
+		slog.Uint64("bytes_uploaded", m.BytesUploaded),
+		slog.Uint64("rejections", m.Rejections),
+		slog.Uint64("client_errors", m.ClientErrors),
+		slog.Uint64("internal_errors", m.InternalErrors),
+	)
+}
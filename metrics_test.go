@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Metrics(t *testing.T) {
+	setFlags(t, "--limit=10")
+	h := &testHaste{}
+	s, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail uploads of "fail", so internal errors can be triggered by the client.
+		b, _ := io.ReadAll(r.Body)
+		if string(b) == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		h.ServeHTTP(w, r)
+	}))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s.listener = l
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run(ctx)
+	}()
+
+	send := func(data string) {
+		t.Helper()
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		_, _ = conn.Write([]byte(data))
+		_ = conn.(*net.TCPConn).CloseWrite()
+		_, _ = io.ReadAll(conn)
+	}
+	send("hello")
+	send("world")
+	send(strings.Repeat("a", 11))
+	send("fail")
+
+	cancel()
+	_ = l.Close()
+	<-runErr
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shutdown: %v", err)
+	}
+
+	want := metricsSnapshot{
+		Connections:    4,
+		Pastes:         2,
+		BytesUploaded:  10,
+		Rejections:     1,
+		ClientErrors:   1,
+		InternalErrors: 1,
+	}
+	if got := s.metricsSnapshot(); got != want {
+		t.Errorf("expected metrics %+v, got %+v", want, got)
+	}
+}
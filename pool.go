@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import "sync"
+
+// taskPool runs best-effort tasks (side effects of a paste, such as appending it to the
+// aggregate file) using a fixed number of workers and a bounded queue.
+//
+// Submitting a task never blocks, if the queue is full the task is dropped. This keeps slow side
+// effects from holding up pastes or piling up goroutines.
+type taskPool struct {
+	mu     sync.RWMutex
+	tasks  chan func()
+	closed bool
+
+	wg sync.WaitGroup
+}
+
+// newTaskPool returns a new task pool and starts its workers.
+func newTaskPool(workers, queueSize int) *taskPool {
+	p := &taskPool{
+		tasks: make(chan func(), max(queueSize, 0)),
+	}
+	for range max(workers, 1) {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// work runs tasks until the pool is closed.
+func (p *taskPool) work() {
+	defer p.wg.Done()
+	for task := range p.tasks {
+		task()
+	}
+}
+
+// Submit queues a task to be run, returning false if the task was dropped because the queue is
+// full or the pool has been closed.
+func (p *taskPool) Submit(task func()) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return false
+	}
+	select {
+	case p.tasks <- task:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops accepting new tasks and waits for all queued tasks to finish.
+func (p *taskPool) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.tasks)
+	}
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTaskPool_Saturated(t *testing.T) {
+	p := newTaskPool(1, 2)
+
+	// Block the only worker, so submitted tasks stay in the queue.
+	started, unblock := make(chan struct{}), make(chan struct{})
+	if !p.Submit(func() {
+		close(started)
+		<-unblock
+	}) {
+		t.Fatal("expected the task to be submitted")
+	}
+	<-started
+
+	var ran atomic.Int64
+	for i := range 2 {
+		if !p.Submit(func() { ran.Add(1) }) {
+			t.Fatalf("expected task %d to be queued", i)
+		}
+	}
+	if p.Submit(func() { ran.Add(1) }) {
+		t.Error("expected the task to be dropped while the queue is full")
+	}
+
+	close(unblock)
+	p.Close()
+	if n := ran.Load(); n != 2 {
+		t.Errorf("expected the 2 queued tasks to run, got %d", n)
+	}
+	if p.Submit(func() {}) {
+		t.Error("expected the task to be dropped after the pool was closed")
+	}
+}
+
+func TestTaskPool_NoQueue(t *testing.T) {
+	p := newTaskPool(1, 0)
+	defer p.Close()
+
+	// Without a queue, a task is only accepted while a worker is waiting for one.
+	unblock := make(chan struct{})
+	defer close(unblock)
+	for !p.Submit(func() { <-unblock }) {
+		// The worker may not have started yet.
+		runtime.Gosched()
+	}
+	if p.Submit(func() {}) {
+		t.Error("expected the task to be dropped while the worker is busy")
+	}
+}
@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// privilegesPortsEnv is set to the privileged ports TestDropPrivilegesHelper should bind to
+// before and after dropping privileges.
+const privilegesPortsEnv = "FICHE_PRIVILEGES_PORTS"
+
+// TestDropPrivilegesHelper is a helper test run using helperCommand by TestDropPrivileges, as
+// dropping privileges can't be undone.
+//
+// It binds to a privileged port, drops privileges to nobody, then reports on stdout whether the
+// listener is still usable and whether binding to another privileged port is now denied.
+func TestDropPrivilegesHelper(t *testing.T) {
+	if !isHelperProcess(t) {
+		return
+	}
+	before, after, _ := strings.Cut(os.Getenv(privilegesPortsEnv), ",")
+	os.Exit(dropPrivilegesHelper(before, after))
+}
+
+// dropPrivilegesHelper binds to before, drops privileges then tries to bind to after.
+func dropPrivilegesHelper(before, after string) int {
+	l, err := net.Listen("tcp", "127.0.0.1:"+before)
+	if err != nil {
+		fmt.Println("failed to bind before dropping privileges:", err)
+		return 1
+	}
+	defer l.Close()
+
+	if err := dropPrivileges(context.Background(), "nobody"); err != nil {
+		fmt.Println("failed to drop privileges:", err)
+		return 1
+	}
+	fmt.Println("uid", os.Getuid(), "gid", os.Getgid())
+
+	// The listener bound before dropping privileges keeps working.
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		fmt.Println("failed to connect to listener:", err)
+		return 1
+	}
+	_ = conn.Close()
+	accepted, err := l.Accept()
+	if err != nil {
+		fmt.Println("failed to accept connection:", err)
+		return 1
+	}
+	_ = accepted.Close()
+
+	// Binding to a privileged port after dropping privileges is denied.
+	if l, err := net.Listen("tcp", "127.0.0.1:"+after); !errors.Is(err, syscall.EACCES) {
+		if l != nil {
+			_ = l.Close()
+		}
+		fmt.Println("expected binding after dropping privileges to be denied, got:", err)
+		return 1
+	}
+	fmt.Println("ok")
+	return 0
+}
+
+// freePrivilegedPorts returns n privileged ports that are not in use.
+func freePrivilegedPorts(t *testing.T, n int) []string {
+	t.Helper()
+	var ports []string
+	for port := 1023; port > 512 && len(ports) < n; port-- {
+		l, err := net.Listen("tcp", "127.0.0.1:"+strconv.Itoa(port))
+		if err != nil {
+			continue
+		}
+		_ = l.Close()
+		ports = append(ports, strconv.Itoa(port))
+	}
+	if len(ports) < n {
+		t.Skip("no free privileged ports")
+	}
+	return ports
+}
+
+func TestDropPrivileges(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("dropping privileges requires running as root")
+	}
+	uid, gid, err := lookupUser("nobody")
+	if err != nil {
+		t.Skipf("no nobody user: %v", err)
+	}
+
+	ports := freePrivilegedPorts(t, 2)
+	cmd := helperCommand(context.Background(), "TestDropPrivilegesHelper", privilegesPortsEnv+"="+strings.Join(ports, ","))
+	out := helperOutput(t, cmd)
+	if want := fmt.Sprint("uid ", uid, " gid ", gid, "\nok\n"); out != want {
+		t.Errorf("expected %q, got %q", want, out)
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	for _, spec := range []string{"root", "0"} {
+		uid, gid, err := lookupUser(spec)
+		if err != nil {
+			t.Fatalf("failed to lookup %q: %v", spec, err)
+		}
+		if uid != 0 || gid != 0 {
+			t.Errorf("expected uid 0 and gid 0 for %q, got %d and %d", spec, uid, gid)
+		}
+	}
+	for _, spec := range []string{"fiche-user-does-not-exist", "4294967294"} {
+		if _, _, err := lookupUser(spec); err == nil {
+			t.Errorf("expected an error for %q", spec)
+		}
+	}
+}
+
+func TestLookupGroup(t *testing.T) {
+	for _, spec := range []string{"root", "0"} {
+		gid, err := lookupGroup(spec)
+		if err != nil {
+			t.Fatalf("failed to lookup %q: %v", spec, err)
+		}
+		if gid != 0 {
+			t.Errorf("expected gid 0 for %q, got %d", spec, gid)
+		}
+	}
+	// Numeric groups are used as-is, they don't need to exist.
+	if gid, err := lookupGroup("12345"); err != nil || gid != 12345 {
+		t.Errorf("expected gid 12345, got %d (%v)", gid, err)
+	}
+	if _, err := lookupGroup("fiche-group-does-not-exist"); err == nil {
+		t.Error("expected an error for an unknown group")
+	}
+}
@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the user (and optional group) in spec, given as
+// `user[:group]` where each may either be a name or a numeric ID. If no group is given, the
+// primary group of the user is used.
+//
+// This must only be called after binding the listener, as an unprivileged user may not be able
+// to bind to a privileged port.
+func dropPrivileges(ctx context.Context, spec string) error {
+	userSpec, groupSpec, _ := strings.Cut(spec, ":")
+	uid, gid, err := lookupUser(userSpec)
+	if err != nil {
+		return err
+	}
+	if groupSpec != "" {
+		if gid, err = lookupGroup(groupSpec); err != nil {
+			return err
+		}
+	}
+
+	// The group must be changed first, as we no longer have permission to once the user changes.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set gid: %w", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set uid: %w", err)
+	}
+	slog.LogAttrs(ctx, slog.LevelInfo, "dropped privileges", slog.Int("uid", uid), slog.Int("gid", gid))
+	return nil
+}
+
+// lookupUser returns the uid and primary gid of a user by name or ID.
+func lookupUser(s string) (int, int, error) {
+	u, err := user.Lookup(s)
+	if err != nil {
+		if _, numErr := strconv.Atoi(s); numErr != nil {
+			return 0, 0, fmt.Errorf("failed to lookup user: %w", err)
+		}
+		if u, err = user.LookupId(s); err != nil {
+			return 0, 0, fmt.Errorf("failed to lookup user: %w", err)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse uid: %w", err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to parse gid: %w", err)
+	}
+	return uid, gid, nil
+}
+
+// lookupGroup returns the gid of a group by name or ID.
+func lookupGroup(s string) (int, error) {
+	if gid, err := strconv.Atoi(s); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(s)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lookup group: %w", err)
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse gid: %w", err)
+	}
+	return gid, nil
+}
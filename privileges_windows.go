@@ -0,0 +1,15 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+func dropPrivileges(ctx context.Context, _ string) error {
+	// Windows has no concept of switching to another uid/gid, so this is a no-op.
+	slog.LogAttrs(ctx, slog.LevelWarn, "--drop-privileges is not supported on windows, ignoring")
+	return nil
+}
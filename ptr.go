@@ -0,0 +1,94 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// maxPTRCacheEntries is the maximum number of cached reverse lookups.
+const maxPTRCacheEntries = 4096
+
+// ptrCacheEntry is a cached reverse lookup result.
+type ptrCacheEntry struct {
+	ok      bool
+	expires time.Time
+}
+
+// ptrChecker checks whether addresses have a reverse DNS (PTR) record.
+//
+// Requiring a PTR record is a crude anti-abuse heuristic, plenty of legitimate clients don't
+// have one and plenty of abusive ones do.
+type ptrChecker struct {
+	// lookupAddr performs a reverse lookup, it is usually (*net.Resolver).LookupAddr.
+	lookupAddr func(ctx context.Context, addr string) ([]string, error)
+	timeout    time.Duration
+	ttl        time.Duration
+
+	mu    sync.Mutex
+	cache map[netip.Addr]ptrCacheEntry
+}
+
+// newPTRChecker returns a new PTR checker using the provided resolver.
+func newPTRChecker(r *net.Resolver, timeout, ttl time.Duration) *ptrChecker {
+	return &ptrChecker{
+		lookupAddr: r.LookupAddr,
+		timeout:    timeout,
+		ttl:        ttl,
+		cache:      make(map[netip.Addr]ptrCacheEntry),
+	}
+}
+
+// HasPTR returns true if addr has a PTR record.
+//
+// If the lookup fails for any reason other than the record not existing (e.g. a timeout), the
+// address is allowed and the result is not cached.
+func (p *ptrChecker) HasPTR(ctx context.Context, addr netip.Addr) bool {
+	now := time.Now()
+	p.mu.Lock()
+	entry, ok := p.cache[addr]
+	p.mu.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.ok
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	names, err := p.lookupAddr(ctx, addr.String())
+	if err != nil {
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return true
+		}
+	}
+	found := len(names) > 0
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.cache) >= maxPTRCacheEntries {
+		p.evictExpired(now)
+	}
+	if len(p.cache) >= maxPTRCacheEntries {
+		// Everything is still valid, start over rather than growing without bound.
+		clear(p.cache)
+	}
+	p.cache[addr] = ptrCacheEntry{ok: found, expires: now.Add(p.ttl)}
+	return found
+}
+
+// evictExpired removes all expired entries from the cache.
+//
+// p.mu must be held when calling evictExpired.
+func (p *ptrChecker) evictExpired(now time.Time) {
+	for addr, entry := range p.cache {
+		if !now.Before(entry.expires) {
+			delete(p.cache, addr)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// mockResolver is a reverse resolver returning fixed results, counting the lookups performed.
+type mockResolver struct {
+	names   map[string][]string
+	err     error
+	lookups int
+}
+
+func (r *mockResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	names, ok := r.names[addr]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+	}
+	return names, nil
+}
+
+// newMockPTRChecker returns a PTR checker using r.
+func newMockPTRChecker(r *mockResolver) *ptrChecker {
+	p := newPTRChecker(net.DefaultResolver, time.Second, time.Minute)
+	p.lookupAddr = r.LookupAddr
+	return p
+}
+
+func TestPTRChecker_HasPTR(t *testing.T) {
+	tests := []struct {
+		name string
+		addr string
+		err  error
+		want bool
+	}{
+		{
+			name: "ptr",
+			addr: "192.0.2.1",
+			want: true,
+		},
+		{
+			name: "no ptr",
+			addr: "192.0.2.2",
+			want: false,
+		},
+		{
+			name: "lookup failure",
+			addr: "192.0.2.2",
+			err:  &net.DNSError{Err: "i/o timeout", IsTimeout: true},
+			want: true,
+		},
+		{
+			name: "other error",
+			addr: "192.0.2.2",
+			err:  errors.New("unexpected error"),
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &mockResolver{
+				names: map[string][]string{"192.0.2.1": {"host.example."}},
+				err:   tt.err,
+			}
+			p := newMockPTRChecker(r)
+			addr := netip.MustParseAddr(tt.addr)
+			if got := p.HasPTR(context.Background(), addr); got != tt.want {
+				t.Errorf("expected %t, got %t", tt.want, got)
+			}
+
+			// Results are cached, unless the lookup failed.
+			_ = p.HasPTR(context.Background(), addr)
+			want := 1
+			if tt.err != nil {
+				want = 2
+			}
+			if r.lookups != want {
+				t.Errorf("expected %d lookups, got %d", want, r.lookups)
+			}
+		})
+	}
+}
+
+func TestPTRChecker_CacheExpiry(t *testing.T) {
+	r := &mockResolver{}
+	p := newMockPTRChecker(r)
+	p.ttl = 0
+
+	addr := netip.MustParseAddr("192.0.2.1")
+	for range 2 {
+		if p.HasPTR(context.Background(), addr) {
+			t.Error("expected no PTR record")
+		}
+	}
+	if r.lookups != 2 {
+		t.Errorf("expected expired results to be looked up again, got %d lookups", r.lookups)
+	}
+}
+
+func TestPTRChecker_CacheBounded(t *testing.T) {
+	p := newMockPTRChecker(&mockResolver{})
+	for i := range maxPTRCacheEntries + 1 {
+		addr := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+		_ = p.HasPTR(context.Background(), addr)
+	}
+	if n := len(p.cache); n > maxPTRCacheEntries {
+		t.Errorf("expected at most %d cached entries, got %d", maxPTRCacheEntries, n)
+	}
+}
+
+func TestHandle_RequirePTR(t *testing.T) {
+	tests := []struct {
+		name  string
+		names map[string][]string
+		err   error
+	}{
+		{
+			name:  "ptr",
+			names: map[string][]string{"127.0.0.1": {"localhost."}},
+		},
+		{
+			name: "no ptr",
+			err:  ErrRejected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t)
+			s, h := newTestServer(t, nil)
+			s.ptr = newMockPTRChecker(&mockResolver{names: tt.names})
+
+			// The connection may be rejected before the data is sent.
+			res, err := roundTripFunc(t, s, func(conn *net.TCPConn) error {
+				_, _ = conn.Write([]byte("hello"))
+				_ = conn.CloseWrite()
+				return nil
+			})
+			if !errors.Is(err, tt.err) {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+			if tt.err == nil {
+				if want := s.haste.URL + "/doc1\n"; res != want {
+					t.Errorf("expected response %q, got %q", want, res)
+				}
+				return
+			}
+			if want := "Connections from addresses without a reverse DNS record are not allowed\n"; res != want {
+				t.Errorf("expected response %q, got %q", want, res)
+			}
+			if docs := h.documents(); len(docs) > 0 {
+				t.Errorf("expected no documents, got %q", docs)
+			}
+		})
+	}
+}
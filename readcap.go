@@ -0,0 +1,44 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"net"
+)
+
+// readCapConn wraps a net.Conn and kills the connection once more than cap bytes have been read
+// from it.
+//
+// This is a safety net in case the paste limit is ever enforced incorrectly, it should never be
+// reached during normal operation.
+type readCapConn struct {
+	net.Conn
+
+	cap  int64
+	read int64
+}
+
+// newReadCapConn returns conn wrapped to only ever read up to cap bytes, or conn as-is if cap is
+// not positive.
+func newReadCapConn(conn net.Conn, cap int64) net.Conn {
+	if cap < 1 {
+		return conn
+	}
+	return &readCapConn{Conn: conn, cap: cap}
+}
+
+// Read satisfies the io.Reader interface.
+func (c *readCapConn) Read(b []byte) (int, error) {
+	if c.read >= c.cap {
+		c.Conn.Close()
+		return 0, ErrReadCapExceeded
+	}
+	// Never read past the cap, so nothing past it is ever buffered.
+	if remaining := c.cap - c.read; int64(len(b)) > remaining {
+		b = b[:remaining]
+	}
+	n, err := c.Conn.Read(b)
+	c.read += int64(n)
+	return n, err
+}
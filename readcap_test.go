@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadCapConn(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	_ = server.SetDeadline(time.Now().Add(10 * time.Second))
+	_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+
+	go func() {
+		_, _ = client.Write(make([]byte, 20))
+	}()
+
+	conn := newReadCapConn(server, 10)
+	var read int
+	buf := make([]byte, 64)
+	for {
+		n, err := conn.Read(buf)
+		read += n
+		if err != nil {
+			if !errors.Is(err, ErrReadCapExceeded) {
+				t.Fatalf("expected ErrReadCapExceeded, got %v", err)
+			}
+			break
+		}
+	}
+	if read != 10 {
+		t.Errorf("expected 10 bytes to be read, got %d", read)
+	}
+
+	// The connection is killed once the cap is reached.
+	if _, err := client.Read(buf); !errors.Is(err, io.EOF) {
+		t.Errorf("expected the connection to be closed, got %v", err)
+	}
+}
+
+func TestNewReadCapConn_Disabled(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	if conn := newReadCapConn(server, 0); conn != server {
+		t.Errorf("expected the connection to be returned as-is, got %T", conn)
+	}
+}
@@ -0,0 +1,162 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// trackedConn wraps a net.Conn and records the time of its last read or write activity.
+type trackedConn struct {
+	net.Conn
+
+	// lastActivity is the time of the last read or write as Unix nanoseconds.
+	lastActivity atomic.Int64
+}
+
+// newTrackedConn returns a new tracked connection wrapping conn.
+func newTrackedConn(conn net.Conn) *trackedConn {
+	c := &trackedConn{Conn: conn}
+	c.touch()
+	return c
+}
+
+// Read satisfies the io.Reader interface.
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// Write satisfies the io.Writer interface.
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.touch()
+	}
+	return n, err
+}
+
+// touch updates the last activity time of the connection to now.
+func (c *trackedConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idleSince returns how long the connection has been idle for as of now.
+func (c *trackedConn) idleSince(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, c.lastActivity.Load()))
+}
+
+// track registers a connection with the server so it can be reaped if it becomes idle.
+func (s *Server) track(conn net.Conn) *trackedConn {
+	c := newTrackedConn(conn)
+	s.connsMu.Lock()
+	s.conns[c] = struct{}{}
+	s.connsMu.Unlock()
+	return c
+}
+
+// untrack removes a connection previously registered with track.
+func (s *Server) untrack(c *trackedConn) {
+	s.connsMu.Lock()
+	delete(s.conns, c)
+	s.connsMu.Unlock()
+}
+
+// reap periodically closes any connections that have been idle for longer than the timeout.
+//
+// This is a safety net independent of the per-read deadlines set in handle, it catches
+// connections that are stuck anywhere else (e.g. while waiting on the haste-server).
+func (s *Server) reap(ctx context.Context, timeout, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.connsMu.Lock()
+			for c := range s.conns {
+				if c.idleSince(now) < timeout {
+					continue
+				}
+				slog.LogAttrs(ctx, slog.LevelInfo, "reaping idle connection", slog.String("remote_addr", logAddr(remoteAddrString(c))))
+				_ = c.Close()
+				delete(s.conns, c)
+			}
+			s.connsMu.Unlock()
+		}
+	}
+}
+
+// maxIdleWait returns the longest a connection may go without any activity while it is being
+// handled, along with the waits (and their flags) that make it up.
+//
+// After a client's last read the waits happen one after another, the read timing out, uploading
+// and verifying each document and delaying the response, so they are summed rather than checked
+// individually.
+func maxIdleWait() (time.Duration, []string) {
+	var (
+		total time.Duration
+		waits []string
+	)
+	add := func(n int, name string, wait time.Duration) {
+		if n < 1 || wait <= 0 {
+			return
+		}
+		total += time.Duration(n) * wait
+		term := name + " (" + wait.String() + ")"
+		if n > 1 {
+			term = strconv.Itoa(n) + " × " + term
+		}
+		waits = append(waits, term)
+	}
+
+	// A read may be delayed to coalesce fragmented data before the final read times out.
+	add(1, "--read-coalesce", CLI.ReadCoalesce)
+	if CLI.AdaptiveTimeout && CLI.AdaptiveTimeoutMax > CLI.ReadTimeout {
+		add(1, "--adaptive-timeout-max", CLI.AdaptiveTimeoutMax)
+	} else {
+		add(1, "--read-timeout", CLI.ReadTimeout)
+	}
+
+	documents := 1
+	switch {
+	case CLI.SplitLarge:
+		documents = CLI.SplitMaxDocuments
+	case CLI.BatchDelimiter != "":
+		documents = CLI.BatchMaxDocuments
+	}
+	// Only the first request after the haste-server has been idle uses the cold start timeout.
+	if CLI.UpstreamColdStartTimeout > CLI.UpstreamTimeout {
+		add(1, "--upstream-cold-start-timeout", CLI.UpstreamColdStartTimeout)
+		add(documents-1, "--upstream-timeout", CLI.UpstreamTimeout)
+	} else {
+		add(documents, "--upstream-timeout", CLI.UpstreamTimeout)
+	}
+	if CLI.VerifyUpload {
+		add(documents, "--verify-upload-timeout", CLI.VerifyUploadTimeout)
+	}
+
+	if CLI.ResponseDelay > 0 && CLI.ResponseDelayScale {
+		add(1, "--response-delay-max", max(CLI.ResponseDelayMax, CLI.ResponseDelay))
+	} else {
+		add(1, "--response-delay", CLI.ResponseDelay)
+	}
+	add(1, "the response write timeout", responseWriteTimeout)
+
+	// A client that never sends anything only waits for its first byte.
+	if CLI.FirstByteTimeout > total {
+		return CLI.FirstByteTimeout, []string{"--first-byte-timeout (" + CLI.FirstByteTimeout.String() + ")"}
+	}
+	return total, waits
+}
@@ -0,0 +1,132 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMaxIdleWait(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		want  time.Duration
+		waits []string
+	}{
+		{
+			name:  "defaults",
+			want:  33 * time.Second,
+			waits: []string{"--read-timeout (2s)", "--upstream-timeout (30s)", "the response write timeout (1s)"},
+		},
+		{
+			name: "split",
+			args: []string{"--split-large", "--split-max-documents=8", "--verify-upload"},
+			want: 2*time.Second + 8*30*time.Second + 8*5*time.Second + time.Second,
+			waits: []string{
+				"--read-timeout (2s)",
+				"8 × --upstream-timeout (30s)",
+				"8 × --verify-upload-timeout (5s)",
+				"the response write timeout (1s)",
+			},
+		},
+		{
+			name: "batch with cold start",
+			args: []string{"--batch-delimiter=---", "--batch-max-documents=3", "--upstream-cold-start-timeout=1m"},
+			want: 2*time.Second + time.Minute + 2*30*time.Second + time.Second,
+			waits: []string{
+				"--read-timeout (2s)",
+				"--upstream-cold-start-timeout (1m0s)",
+				"2 × --upstream-timeout (30s)",
+				"the response write timeout (1s)",
+			},
+		},
+		{
+			name: "adaptive timeout and coalescing",
+			args: []string{"--adaptive-timeout", "--adaptive-timeout-max=5s", "--read-coalesce=10ms"},
+			want: 10*time.Millisecond + 5*time.Second + 30*time.Second + time.Second,
+			waits: []string{
+				"--read-coalesce (10ms)",
+				"--adaptive-timeout-max (5s)",
+				"--upstream-timeout (30s)",
+				"the response write timeout (1s)",
+			},
+		},
+		{
+			name:  "adaptive timeout disabled",
+			args:  []string{"--adaptive-timeout-max=5m"},
+			want:  33 * time.Second,
+			waits: []string{"--read-timeout (2s)", "--upstream-timeout (30s)", "the response write timeout (1s)"},
+		},
+		{
+			name:  "scaled response delay",
+			args:  []string{"--response-delay=1s", "--response-delay-scale", "--response-delay-max=2m"},
+			want:  2*time.Second + 30*time.Second + 2*time.Minute + time.Second,
+			waits: []string{"--read-timeout (2s)", "--upstream-timeout (30s)", "--response-delay-max (2m0s)", "the response write timeout (1s)"},
+		},
+		{
+			name:  "first byte timeout",
+			args:  []string{"--first-byte-timeout=5m"},
+			want:  5 * time.Minute,
+			waits: []string{"--first-byte-timeout (5m0s)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			got, waits := maxIdleWait()
+			if got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+			if !slices.Equal(waits, tt.waits) {
+				t.Errorf("expected %q, got %q", tt.waits, waits)
+			}
+		})
+	}
+}
+
+func TestReap(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+
+	idle, idlePeer := net.Pipe()
+	defer idlePeer.Close()
+	active, activePeer := net.Pipe()
+	defer activePeer.Close()
+	idleConn := s.track(idle)
+	activeConn := s.track(active)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.reap(ctx, 100*time.Millisecond, 10*time.Millisecond)
+
+	// Keep one of the connections active while the other one is reaped.
+	go func() {
+		_, _ = io.Copy(io.Discard, activePeer)
+	}()
+	for range 20 {
+		if _, err := activeConn.Write([]byte("a")); err != nil {
+			t.Fatalf("active connection was closed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := idleConn.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("expected the idle connection to be closed, got %v", err)
+	}
+	s.connsMu.Lock()
+	_, idleTracked := s.conns[idleConn]
+	_, activeTracked := s.conns[activeConn]
+	s.connsMu.Unlock()
+	if idleTracked {
+		t.Error("expected the idle connection to no longer be tracked")
+	}
+	if !activeTracked {
+		t.Error("expected the active connection to still be tracked")
+	}
+}
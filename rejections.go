@@ -0,0 +1,154 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"log/slog"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// rejectionPrefixV4 is the prefix length IPv4 addresses are aggregated by.
+	rejectionPrefixV4 = 24
+	// rejectionPrefixV6 is the prefix length IPv6 addresses are aggregated by.
+	rejectionPrefixV6 = 48
+	// maxRejectionPrefixes is the maximum number of prefixes tracked at once.
+	maxRejectionPrefixes = 1024
+)
+
+// Reasons a connection may be rejected for.
+const (
+	rejectReasonSize        = "size"
+	rejectReasonContentType = "content_type"
+	rejectReasonPTR         = "ptr"
+	rejectReasonTor         = "tor"
+	rejectReasonLoad        = "load"
+	rejectReasonUploads     = "uploads"
+	rejectReasonReads       = "reads"
+	rejectReasonMaxTotal    = "max_total"
+)
+
+// prefixRejections are the rejections recorded for a single network prefix.
+type prefixRejections struct {
+	Prefix  netip.Prefix
+	Total   uint64
+	Reasons map[string]uint64
+}
+
+// rejectionStats aggregates rejections by network prefix (/24 for IPv4 and /48 for IPv6).
+//
+// Aggregating by prefix allows a noisy network to be spotted without tracking every individual
+// address. The number of tracked prefixes is bounded, once the limit is reached the prefix that
+// was least recently rejected is evicted to make room for a new one.
+//
+// A nil *rejectionStats records nothing, this is used when rejections aren't logged.
+type rejectionStats struct {
+	mu       sync.Mutex
+	prefixes map[netip.Prefix]*list.Element
+	// recent orders the tracked prefixes by their most recent rejection, most recent first.
+	recent *list.List
+}
+
+// newRejectionStats returns a new, empty rejectionStats.
+func newRejectionStats() *rejectionStats {
+	return &rejectionStats{
+		prefixes: make(map[netip.Prefix]*list.Element),
+		recent:   list.New(),
+	}
+}
+
+// Record records a rejection of the provided address for the provided reason.
+func (r *rejectionStats) Record(addr netip.Addr, reason string) {
+	if r == nil || !addr.IsValid() {
+		return
+	}
+	addr = addr.Unmap()
+	bits := rejectionPrefixV6
+	if addr.Is4() {
+		bits = rejectionPrefixV4
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.prefixes[prefix]
+	if ok {
+		r.recent.MoveToFront(e)
+	} else {
+		if len(r.prefixes) >= maxRejectionPrefixes {
+			oldest := r.recent.Back()
+			r.recent.Remove(oldest)
+			delete(r.prefixes, oldest.Value.(*prefixRejections).Prefix)
+		}
+		e = r.recent.PushFront(&prefixRejections{Prefix: prefix, Reasons: make(map[string]uint64)})
+		r.prefixes[prefix] = e
+	}
+	p := e.Value.(*prefixRejections)
+	p.Total++
+	p.Reasons[reason]++
+}
+
+// Flush returns the n prefixes with the most rejections and resets all recorded rejections.
+func (r *rejectionStats) Flush(n int) []*prefixRejections {
+	r.mu.Lock()
+	prefixes := make([]*prefixRejections, 0, len(r.prefixes))
+	for e := r.recent.Front(); e != nil; e = e.Next() {
+		prefixes = append(prefixes, e.Value.(*prefixRejections))
+	}
+	r.prefixes = make(map[netip.Prefix]*list.Element)
+	r.recent.Init()
+	r.mu.Unlock()
+
+	slices.SortFunc(prefixes, func(a, b *prefixRejections) int {
+		if a.Total != b.Total {
+			// Sort by descending total.
+			if a.Total > b.Total {
+				return -1
+			}
+			return 1
+		}
+		return a.Prefix.Addr().Compare(b.Prefix.Addr())
+	})
+	if len(prefixes) > n {
+		prefixes = prefixes[:n]
+	}
+	return prefixes
+}
+
+// logRejections periodically logs the prefixes with the most rejections.
+func (s *Server) logRejections(ctx context.Context, interval time.Duration, n int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, p := range s.rejections.Flush(n) {
+				attrs := make([]slog.Attr, 0, len(p.Reasons))
+				for reason, count := range p.Reasons {
+					attrs = append(attrs, slog.Uint64(reason, count))
+				}
+				slog.LogAttrs(
+					ctx,
+					slog.LevelInfo,
+					"rejected connections",
+					slog.String("prefix", p.Prefix.String()),
+					slog.Uint64("total", p.Total),
+					slog.Any("reasons", slog.GroupValue(attrs...)),
+				)
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestRejectionStats(t *testing.T) {
+	r := newRejectionStats()
+	r.Record(netip.MustParseAddr("192.0.2.1"), rejectReasonSize)
+	r.Record(netip.MustParseAddr("192.0.2.200"), rejectReasonPTR)
+	r.Record(netip.MustParseAddr("::ffff:198.51.100.1"), rejectReasonSize)
+	r.Record(netip.MustParseAddr("2001:db8:1:2::1"), rejectReasonTor)
+
+	prefixes := r.Flush(2)
+	if len(prefixes) != 2 {
+		t.Fatalf("expected 2 prefixes, got %d", len(prefixes))
+	}
+	if p := prefixes[0]; p.Prefix != netip.MustParsePrefix("192.0.2.0/24") || p.Total != 2 ||
+		p.Reasons[rejectReasonSize] != 1 || p.Reasons[rejectReasonPTR] != 1 {
+		t.Errorf("unexpected first prefix %+v", p)
+	}
+	if p := prefixes[1]; p.Prefix != netip.MustParsePrefix("198.51.100.0/24") || p.Total != 1 {
+		t.Errorf("unexpected second prefix %+v", p)
+	}
+
+	// Flushing resets the recorded rejections.
+	if prefixes := r.Flush(10); len(prefixes) != 0 {
+		t.Errorf("expected no prefixes after flushing, got %d", len(prefixes))
+	}
+}
+
+func TestRejectionStats_Evict(t *testing.T) {
+	r := newRejectionStats()
+	first := netip.MustParseAddr("10.0.0.1")
+	r.Record(first, rejectReasonSize)
+	second := netip.MustParseAddr("10.0.1.1")
+	r.Record(second, rejectReasonSize)
+	for i := range maxRejectionPrefixes - 2 {
+		r.Record(netip.AddrFrom4([4]byte{10, 1 + byte(i>>8), byte(i), 1}), rejectReasonSize)
+	}
+	// Rejecting the first prefix again makes the second the least recently rejected one.
+	r.Record(first, rejectReasonSize)
+	r.Record(netip.MustParseAddr("10.100.0.1"), rejectReasonSize)
+
+	prefixes := r.Flush(maxRejectionPrefixes + 1)
+	if len(prefixes) != maxRejectionPrefixes {
+		t.Fatalf("expected %d prefixes, got %d", maxRejectionPrefixes, len(prefixes))
+	}
+	for _, p := range prefixes {
+		if p.Prefix.Contains(second) {
+			t.Errorf("expected %s to be evicted", p.Prefix)
+		}
+	}
+	if !prefixes[0].Prefix.Contains(first) || prefixes[0].Total != 2 {
+		t.Errorf("expected %s to be kept, got %+v", first, prefixes[0])
+	}
+}
+
+func TestRejectionStats_Nil(t *testing.T) {
+	var r *rejectionStats
+	// Recording must be a no-op when rejections aren't logged.
+	r.Record(netip.MustParseAddr("192.0.2.1"), rejectReasonSize)
+}
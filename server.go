@@ -0,0 +1,903 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/matthewpi/fiche/internal/ansi"
+	"github.com/matthewpi/fiche/internal/encrypt"
+	"github.com/matthewpi/fiche/internal/haste"
+	"github.com/matthewpi/fiche/internal/logctx"
+	"github.com/matthewpi/fiche/internal/sniff"
+	"github.com/matthewpi/fiche/internal/viewtoken"
+)
+
+// Server is responsible for listening for incoming connections, reading data, and forwarding it
+// to a haste-server.
+type Server struct {
+	listener net.Listener
+	haste    *haste.Client
+
+	connsMu sync.Mutex
+	conns   map[*trackedConn]struct{}
+
+	// wg tracks in-flight connections so they can be drained on shutdown.
+	wg sync.WaitGroup
+
+	// aggregate, if set, receives a copy of every paste.
+	aggregate *aggregator
+
+	// sideEffects runs best-effort tasks after a paste has been created.
+	sideEffects *taskPool
+
+	// ptr, if set, is used to reject clients without a reverse DNS record.
+	ptr *ptrChecker
+	// tor, if set, is used to reject (or log) clients connecting from Tor exit nodes.
+	tor *exitList
+	// uploads, if set, limits the number of concurrent uploads per address.
+	uploads *uploadLimiter
+
+	// requestRate counts recent requests per address, used to scale the response delay.
+	requestRate *requestRate
+
+	// latency records the latency of requests to the haste-server.
+	latency latencyHistogram
+	// metrics are counters describing the activity of the server.
+	metrics metrics
+
+	// pastes is the total number of pastes created (or being created) by the server.
+	pastes atomic.Int64
+	// created is the total number of pastes successfully created by the server.
+	created atomic.Int64
+	// stop, if set, is called to gracefully stop the server once `--max-total-pastes` has been
+	// reached and `--shutdown-after-max` is enabled.
+	stop context.CancelFunc
+
+	// rejections, if set, tracks rejected connections by network prefix so they can be logged.
+	rejections *rejectionStats
+}
+
+// NewServer returns a new server using the provided listener and haste-server client.
+func NewServer(l net.Listener, h *haste.Client) *Server {
+	return &Server{
+		listener: l,
+		haste:    h,
+		conns:    make(map[*trackedConn]struct{}),
+
+		requestRate: newRequestRate(),
+		sideEffects: newTaskPool(CLI.SideEffectWorkers, CLI.SideEffectQueue),
+	}
+}
+
+// Run runs the server, listening for incoming connections on the server's listener.
+func (s *Server) Run(ctx context.Context) error {
+	slog.LogAttrs(ctx, slog.LevelInfo, "listening for incoming connections...")
+	if CLI.IdleTimeout > 0 && CLI.IdleSweepInterval > 0 {
+		go s.reap(ctx, CLI.IdleTimeout, CLI.IdleSweepInterval)
+	}
+	if s.rejections != nil && CLI.RejectionLogInterval > 0 {
+		go s.logRejections(ctx, CLI.RejectionLogInterval, CLI.RejectionLogTop)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+			conn, err := s.listener.Accept()
+			if err != nil {
+				// Ignore `use of closed network connection` errors, these are triggered when the
+				// server is shutting down.
+				if strings.HasSuffix(err.Error(), "use of closed network connection") {
+					break
+				}
+				slog.LogAttrs(ctx, slog.LevelWarn, "error while accepting connection", slog.Any("err", err))
+				break
+			}
+
+			// Shed load by rejecting new connections while the server is overloaded.
+			if threshold := s.overloaded(); threshold != "" {
+				remoteAddr := remoteAddrString(conn)
+				s.reject(remoteAddr, rejectReasonLoad)
+				slog.LogAttrs(
+					ctx,
+					slog.LevelDebug,
+					"rejected connection, server is overloaded",
+					slog.String("remote_addr", logAddr(remoteAddr)),
+					slog.String("threshold", threshold),
+				)
+				_ = writeResponse(conn, []byte("Server is busy, please try again later\n"))
+				_ = conn.Close()
+				break
+			}
+
+			// Handle the connection in the background.
+			//
+			// The connection is handled using a context that isn't canceled when the server is
+			// shutting down, this allows in-flight pastes and responses to complete while the
+			// server is being drained. Every log for the connection includes its ID.
+			s.wg.Add(1)
+			s.metrics.connections.Add(1)
+			s.metrics.activeConnections.Add(1)
+			go func(ctx context.Context, conn *trackedConn) {
+				defer s.wg.Done()
+				defer s.metrics.activeConnections.Add(-1)
+				defer s.untrack(conn)
+				// Recover from any panics while handling the connection, so a single bad
+				// connection can't take down the entire server.
+				defer func() {
+					if r := recover(); r != nil {
+						_ = conn.Close()
+						slog.LogAttrs(
+							ctx,
+							slog.LevelError,
+							"panic while handling connection",
+							slog.Any("panic", r),
+							slog.String("stack", string(debug.Stack())),
+						)
+					}
+				}()
+				if err := s.handle(ctx, conn); err != nil {
+					// Errors caused by clients are expected, don't log them as warnings.
+					level := slog.LevelWarn
+					if errors.Is(err, ErrClient) {
+						level = slog.LevelInfo
+						s.metrics.clientErrors.Add(1)
+					} else if errors.Is(err, ErrInternal) {
+						s.metrics.internalErrors.Add(1)
+					}
+					slog.LogAttrs(ctx, level, "error while handling connection", slog.Any("err", err))
+				}
+			}(logctx.With(context.WithoutCancel(ctx), slog.String("conn_id", newConnID())), s.track(conn))
+		}
+	}
+}
+
+// Shutdown waits for all in-flight connections to finish. If the context is canceled before
+// all connections have finished, any remaining connections are forcibly closed.
+//
+// Shutdown should only be called after the server's listener has been closed.
+func (s *Server) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		// All connections have finished, so no more side effects can be submitted.
+		s.sideEffects.Close()
+		return nil
+	case <-ctx.Done():
+		s.connsMu.Lock()
+		for c := range s.conns {
+			_ = c.Close()
+		}
+		s.connsMu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// LogLatencySummary logs a summary of the latency of requests to the haste-server.
+func (s *Server) LogLatencySummary(ctx context.Context) {
+	count := s.latency.Count()
+	if count == 0 {
+		return
+	}
+	slog.LogAttrs(
+		ctx,
+		slog.LevelInfo,
+		"upstream latency summary",
+		slog.Uint64("count", count),
+		slog.Duration("p50", s.latency.Percentile(0.5)),
+		slog.Duration("p90", s.latency.Percentile(0.9)),
+		slog.Duration("p99", s.latency.Percentile(0.99)),
+		slog.Duration("max", s.latency.Max()),
+	)
+}
+
+// maxConsecutiveEmptyReads is the maximum number of consecutive reads returning no data and no
+// error before a connection is considered broken, matching bufio.
+const maxConsecutiveEmptyReads = 100
+
+// maxTotalPastesMessage is sent to clients once `--max-total-pastes` has been reached.
+const maxTotalPastesMessage = "This server is no longer accepting pastes\n"
+
+// handle handles an incoming connection from the listener.
+func (s *Server) handle(ctx context.Context, conn net.Conn) (err error) {
+	remoteAddr := remoteAddrString(conn)
+	slog.LogAttrs(ctx, slog.LevelInfo, "new connection", slog.String("remote_addr", logAddr(remoteAddr)))
+	defer slog.LogAttrs(ctx, slog.LevelInfo, "connection closed", slog.String("remote_addr", logAddr(remoteAddr)))
+	defer conn.Close()
+
+	stats := newStatsConn(conn, CLI.DiagnosticsOnError)
+	defer func() {
+		if err != nil && stats.diagnostics {
+			stats.logDiagnostics(ctx, err)
+			return
+		}
+		stats.log(ctx)
+	}()
+	conn = stats
+
+	// Avoid reading a paste we know we won't accept.
+	if CLI.MaxTotalPastes > 0 && s.pastes.Load() >= CLI.MaxTotalPastes {
+		s.reject(remoteAddr, rejectReasonMaxTotal)
+		return respondWithError(conn, ErrRejected, maxTotalPastesMessage)
+	}
+
+	if s.ptr != nil {
+		addrPort, err := netip.ParseAddrPort(remoteAddr)
+		if err == nil && !s.ptr.HasPTR(ctx, addrPort.Addr().Unmap()) {
+			s.reject(remoteAddr, rejectReasonPTR)
+			msg := "Connections from addresses without a reverse DNS record are not allowed\n"
+			return respondWithError(conn, ErrRejected, msg)
+		}
+	}
+
+	// Kill the connection if we ever read more than the hard cap, regardless of the limit.
+	conn = newReadCapConn(conn, CLI.HardReadCap)
+
+	if s.tor != nil {
+		addrPort, err := netip.ParseAddrPort(remoteAddr)
+		if err == nil && s.tor.Contains(addrPort.Addr()) {
+			if CLI.TorBlockAction == torBlockReject {
+				s.reject(remoteAddr, rejectReasonTor)
+				msg := "Connections from Tor exit nodes are not allowed\n"
+				return respondWithError(conn, ErrRejected, msg)
+			}
+			slog.LogAttrs(ctx, slog.LevelInfo, "connection from tor exit node", slog.String("remote_addr", logAddr(remoteAddr)))
+		}
+	}
+
+	// buf is all the data read from the connection.
+	buf := newSpillBuffer(ctx, CLI.SpillToDisk, CLI.SpillDir)
+	defer buf.Close()
+	// tmp is used to read smaller chunks of data from the connection.
+	tmp := make([]byte, readBufferSize())
+	// adaptive is used to scale the read timeout based on the connection's throughput.
+	var adaptive *adaptiveTimeout
+	if CLI.AdaptiveTimeout {
+		adaptive = newAdaptiveTimeout(CLI.AdaptiveTimeoutMin, CLI.AdaptiveTimeoutMax, time.Now())
+	}
+	// emptyReads is the number of consecutive reads that returned no data and no error.
+	var emptyReads int
+	// dataReads is the number of reads that returned data.
+	var dataReads int
+	for {
+		// Reset the read deadline on each iteration, this functions as a timeout for each read.
+		readTimeout := CLI.ReadTimeout
+		if adaptive != nil {
+			readTimeout = adaptive.timeout()
+		}
+		if buf.Len() < 1 && CLI.FirstByteTimeout > 0 {
+			// Clients may take a while to start sending (e.g. someone typing), but once they have
+			// the rest of the paste should follow quickly.
+			readTimeout = CLI.FirstByteTimeout
+		}
+		if err := conn.SetReadDeadline(time.Now().Add(readTimeout)); err != nil {
+			return fmt.Errorf("failed to set read deadline: %w", err)
+		}
+
+		// Never read more than one byte past the limit, this ensures we don't buffer any more
+		// data than necessary to detect that a paste is too large. The limit itself is inclusive,
+		// so only that extra byte causes a paste to be rejected.
+		n, err := conn.Read(tmp[:min(len(tmp), pasteLimit()-buf.Len()+1)])
+		if err != nil {
+			// Normally you would wait for an io.EOF here, but netcat doesn't send an EOF when it's
+			// finished, so we just have to assume that it finished sending data after a timeout
+			// is reached.
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if buf.Len() < 1 {
+					slog.LogAttrs(ctx, slog.LevelInfo, "no data received from client before connection timed out")
+					writeUsage(conn)
+					return nil
+				}
+
+				// Got data from client, break.
+				break
+			}
+
+			// The client aborted the connection (e.g. by sending a RST), what was received before
+			// that may still be a complete paste.
+			if errors.Is(err, syscall.ECONNRESET) {
+				if buf.Len() < 1 {
+					slog.LogAttrs(ctx, slog.LevelInfo, "connection reset by client before any data was received")
+					return nil
+				}
+				if CLI.ResetAction == resetActionDiscard {
+					return fmt.Errorf("%w: discarded %d bytes: %w", ErrConnectionReset, buf.Len(), err)
+				}
+				break
+			}
+
+			// Don't keep reading from a broken connection, this includes the connection being
+			// closed underneath us (most likely by the idle reaper) and the hard read cap being
+			// reached.
+			if !errors.Is(err, io.EOF) {
+				return fmt.Errorf("failed to read from connection: %w", err)
+			}
+		}
+
+		// A read may legitimately return no data and no error, but a connection that keeps
+		// doing so isn't making any progress and would otherwise keep us spinning.
+		if n == 0 && err == nil {
+			emptyReads++
+			if emptyReads >= maxConsecutiveEmptyReads {
+				return io.ErrNoProgress
+			}
+			continue
+		}
+		emptyReads = 0
+
+		// Bound the cost of clients dribbling a paste one byte at a time, only reads that returned
+		// data are counted (not the final read returning EOF or timing out).
+		if n > 0 {
+			dataReads++
+		}
+		if CLI.MaxReadsPerConn > 0 && dataReads > CLI.MaxReadsPerConn {
+			s.reject(remoteAddr, rejectReasonReads)
+			msg := "Pastes may not be sent using more than " + strconv.Itoa(CLI.MaxReadsPerConn) + " reads\n"
+			return respondWithError(conn, ErrTooManyReads, msg)
+		}
+
+		if adaptive != nil {
+			adaptive.observe(n, time.Now())
+		}
+		if _, err := buf.Write(tmp[:n]); err != nil {
+			return fmt.Errorf("%w: %w", ErrInternal, err)
+		}
+		if limit := pasteLimit(); buf.Len() > limit {
+			s.reject(remoteAddr, rejectReasonSize)
+			// TODO: it would be nice if we could pretty print the limit rather than always sending
+			// it as the number of bytes.
+			msg := "Pastes may not exceed " + strconv.Itoa(limit) + " bytes of data"
+			return respondWithError(conn, ErrLimitExceeded, msg)
+		}
+
+		// The client closed its side of the connection, so the paste is complete. The final read
+		// may have returned data along with the EOF, which has already been buffered above.
+		if errors.Is(err, io.EOF) {
+			if buf.Len() < 1 {
+				slog.LogAttrs(ctx, slog.LevelInfo, "no data received from client before connection was closed")
+				writeUsage(conn)
+				return nil
+			}
+			break
+		}
+
+		// Give a fragmented stream a moment to accumulate more data, so the rest of it can be
+		// read using fewer (and larger) reads.
+		if CLI.ReadCoalesce > 0 && n < len(tmp) {
+			sleep(ctx, CLI.ReadCoalesce)
+		}
+	}
+
+	// Strip any leading directives from the data.
+	//
+	// If the paste was spilled to disk only its start is in memory, none of the features that
+	// require the entire paste can be enabled in that case.
+	d, content, err := parseDirectives(buf.Bytes())
+	if err != nil {
+		if errors.Is(err, errInvalidCustomKey) {
+			msg := "Custom keys may only contain letters, numbers, '-' and '_' and be at most " +
+				strconv.Itoa(maxCustomKeyLength) + " characters\n"
+			return respondWithError(conn, ErrInvalidDirective, msg)
+		}
+		if errors.Is(err, errInvalidFilename) {
+			msg := "Filenames must be at most " + strconv.Itoa(maxFilenameLength) +
+				" bytes and may not contain path separators or control characters\n"
+			return respondWithError(conn, ErrInvalidDirective, msg)
+		}
+		if errors.Is(err, errDirectiveValueTooLong) {
+			msg := "Directive values may not exceed " + strconv.Itoa(CLI.MaxDirectiveValue) + " bytes\n"
+			return respondWithError(conn, ErrInvalidDirective, msg)
+		}
+		if errors.Is(err, errDirectiveTooLong) {
+			msg := "Directive lines may not exceed " + strconv.Itoa(CLI.MaxDirectiveLine) + " bytes\n"
+			return respondWithError(conn, ErrInvalidDirective, msg)
+		}
+		return err
+	}
+
+	// Let clients correlate our logs with their own.
+	if d.traceID != "" {
+		slog.LogAttrs(ctx, slog.LevelInfo, "using client provided connection id", slog.String("client_conn_id", d.traceID))
+		logctx.Set(ctx, slog.String("conn_id", d.traceID))
+	}
+
+	if CLI.StripANSI {
+		content = ansi.Strip(content)
+	}
+
+	// A client that only sent directives (or escape sequences) hasn't sent a paste, don't upload
+	// an empty document for it.
+	if len(content) < 1 {
+		slog.LogAttrs(ctx, slog.LevelInfo, "no content received from client after directives")
+		writeUsage(conn)
+		return nil
+	}
+
+	if len(CLI.AllowedContentTypes) > 0 {
+		contentType := sniff.ContentType(content)
+		if !sniff.MatchContentType(contentType, CLI.AllowedContentTypes) {
+			s.reject(remoteAddr, rejectReasonContentType)
+			return respondWithError(conn, ErrRejected, "Pastes of type "+contentType+" are not allowed\n")
+		}
+	}
+
+	// Split the data into multiple documents if it is too large for a single one, or if the
+	// client sent a batch of documents.
+	chunks := [][]byte{content}
+	if CLI.SplitLarge {
+		chunks = splitContent(content, CLI.SplitSize)
+		// Splitting on line boundaries may need more documents than the limit accounts for.
+		if len(chunks) > CLI.SplitMaxDocuments {
+			s.reject(remoteAddr, rejectReasonSize)
+			msg := "Pastes may not be split into more than " + strconv.Itoa(CLI.SplitMaxDocuments) + " documents\n"
+			return respondWithError(conn, ErrLimitExceeded, msg)
+		}
+	}
+	if CLI.BatchDelimiter != "" {
+		chunks = splitBatch(content, CLI.BatchDelimiter)
+		if err := checkBatch(conn, chunks); err != nil {
+			if errors.Is(err, ErrLimitExceeded) {
+				s.reject(remoteAddr, rejectReasonSize)
+			}
+			return err
+		}
+	}
+	if d.key != "" && len(chunks) > 1 {
+		msg := "Custom keys cannot be used with pastes that are split into multiple documents\n"
+		return respondWithError(conn, ErrInvalidDirective, msg)
+	}
+
+	// Encrypt the data if requested, the key is only ever given to the client.
+	var parts urlParts
+	if CLI.ClientSideEncrypt {
+		encryptionKey, err := encrypt.NewKey()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInternal, err)
+		}
+		for i, chunk := range chunks {
+			if chunks[i], err = encrypt.Seal(encryptionKey, chunk); err != nil {
+				return fmt.Errorf("%w: failed to encrypt paste: %w", ErrInternal, err)
+			}
+		}
+		parts.fragment = encrypt.Fragment(encryptionKey)
+	}
+
+	// Limit how many uploads a single address may have in-flight at once.
+	if s.uploads != nil {
+		if addrPort, err := netip.ParseAddrPort(remoteAddr); err == nil {
+			addr := addrPort.Addr().Unmap()
+			if !s.uploads.Acquire(addr) {
+				s.reject(remoteAddr, rejectReasonUploads)
+				msg := "Too many uploads in progress from your address, please try again later\n"
+				return respondWithError(conn, ErrRejected, msg)
+			}
+			defer s.uploads.Release(addr)
+		}
+	}
+
+	// Reserve a paste against the global cap before uploading, so concurrent connections can't
+	// exceed it.
+	reserved := s.pastes.Add(1)
+	if CLI.MaxTotalPastes > 0 && reserved > CLI.MaxTotalPastes {
+		s.pastes.Add(-1)
+		s.reject(remoteAddr, rejectReasonMaxTotal)
+		return respondWithError(conn, ErrRejected, maxTotalPastesMessage)
+	}
+
+	// Send the data to the haste-server, pastes spilled to disk are streamed from it rather than
+	// being read back into memory.
+	var docs []*haste.PasteResponse
+	if buf.Spilled() {
+		docs, err = s.uploadReader(ctx, buf.Reader())
+	} else {
+		docs, err = s.upload(ctx, d.key, chunks)
+	}
+	if err != nil {
+		s.pastes.Add(-1)
+		if errors.Is(err, haste.ErrKeyTaken) {
+			return respondWithError(conn, ErrRejected, "The key \""+d.key+"\" is already taken\n")
+		}
+		var resolveErr *haste.ResolveError
+		if errors.As(err, &resolveErr) {
+			slog.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"cannot resolve upstream host",
+				slog.String("host", resolveErr.Host),
+				slog.Any("err", resolveErr.Err),
+			)
+			msg := "Backend unavailable, please try again later\n"
+			return respondWithError(conn, fmt.Errorf("%w: %w", ErrUpstream, err), msg)
+		}
+		// The haste-server refusing our requests is something the operator needs to fix.
+		var statusErr haste.StatusError
+		if errors.As(err, &statusErr) && (statusErr.StatusCode == http.StatusUnauthorized || statusErr.StatusCode == http.StatusForbidden) {
+			slog.LogAttrs(
+				ctx,
+				slog.LevelError,
+				"upstream authentication failed, check the haste-server's credentials",
+				slog.Int("status", statusErr.StatusCode),
+			)
+			msg := "Backend misconfigured, please try again later\n"
+			return respondWithError(conn, fmt.Errorf("%w: %w", ErrUpstream, err), msg)
+		}
+		if errors.Is(err, errUploadMismatch) {
+			msg := "The paste was corrupted by the backend, please try again later\n"
+			return respondWithError(conn, fmt.Errorf("%w: %w", ErrUpstream, err), msg)
+		}
+		return fmt.Errorf("%w: failed to forward data to hastebin: %w", ErrUpstream, err)
+	}
+	// Only stop once the pastes have actually been created, a reserved paste may still fail.
+	created := s.created.Add(1)
+	if CLI.MaxTotalPastes > 0 && created == CLI.MaxTotalPastes && CLI.ShutdownAfterMax && s.stop != nil {
+		slog.LogAttrs(ctx, slog.LevelInfo, "maximum total pastes reached, shutting down")
+		s.stop()
+	}
+
+	if s.aggregate != nil {
+		ip, _, err := net.SplitHostPort(remoteAddr)
+		if err != nil {
+			ip = remoteAddr
+		}
+		now := time.Now()
+		s.submitSideEffect(ctx, "aggregate", func() {
+			if err := s.aggregate.Append(now, ip, content); err != nil {
+				slog.LogAttrs(ctx, slog.LevelWarn, "failed to append paste to aggregate file", slog.Any("err", err))
+			}
+		})
+	}
+
+	// Write the URL of each document back to the client, each on their own line.
+	if ext := d.ext(); ext != "" {
+		// The client knows better than our guesses.
+		parts.ext = ext
+	} else if CLI.AutoExtension {
+		parts.ext = sniff.Extension(content, CLI.SniffDefault)
+	}
+	var res []byte
+	if CLI.Identify {
+		// Sent as a comment on its own line, so the URL(s) remain parseable.
+		res = append(res, "# fiche "+getVersion()+"\n"...)
+	}
+	for _, doc := range docs {
+		if CLI.ViewTokenSecret != "" {
+			token := viewtoken.Generate([]byte(CLI.ViewTokenSecret), doc.Key, time.Now().Add(CLI.ViewTokenTTL))
+			parts.query = viewtoken.QueryParam + "=" + token
+		}
+		if len(CLI.Links) == 0 {
+			res = s.appendURL(res, doc, parts)
+			continue
+		}
+		res = s.appendLinks(res, doc, parts, CLI.Links)
+	}
+	if !CLI.ResponseTrailingNewline {
+		res = bytes.TrimSuffix(res, []byte{'\n'})
+	}
+
+	// Slow down scripts hammering the server, this is unnoticeable to humans.
+	sleep(ctx, s.responseDelay(remoteAddr))
+	if err := writeResponse(conn, res); err != nil {
+		// The paste was still created, so log where it can be found rather than losing it. Only
+		// the keys are logged, the URLs may contain the encryption key and view token which must
+		// only ever be given to the client.
+		keys := make([]string, len(docs))
+		for i, doc := range docs {
+			keys[i] = doc.Key
+		}
+		slog.LogAttrs(
+			ctx,
+			slog.LevelWarn,
+			"paste created but the client disconnected before receiving its url",
+			slog.Any("keys", keys),
+			slog.Any("err", err),
+		)
+	}
+	return nil
+}
+
+// urlParts are the optional parts of a URL returned to a client.
+type urlParts struct {
+	// dir is prepended to the key in the URL's path, e.g. "raw/".
+	dir string
+	// ext is appended to the URL as a file extension, so the haste-server will use it for
+	// syntax highlighting.
+	ext string
+	// query is appended to the URL as its (already encoded) query string.
+	query string
+	// fragment is appended to the URL as its fragment.
+	fragment string
+}
+
+// Link formats that may be requested using --links.
+const (
+	linkViewer   = "viewer"
+	linkRaw      = "raw"
+	linkDownload = "download"
+)
+
+// appendLinks appends a labeled line for each of the link formats to b.
+func (s *Server) appendLinks(b []byte, doc *haste.PasteResponse, p urlParts, formats []string) []byte {
+	for _, format := range formats {
+		link := p
+		switch format {
+		case linkRaw:
+			// The encryption key is useless for raw content, so don't hand it out.
+			link.dir, link.ext, link.fragment = "raw/", "", ""
+		case linkDownload:
+			// The haste-server serves raw documents as plain text, an extension gives the
+			// download a sensible filename.
+			link.dir, link.fragment = "raw/", ""
+			if link.ext == "" {
+				link.ext = "txt"
+			}
+		}
+		b = append(b, format+": "...)
+		b = s.appendURL(b, doc, link)
+	}
+	return b
+}
+
+// appendURL appends the URL of the document to b, followed by a newline.
+//
+// If the haste-server returned the URL of the document it is used as-is, except for when the
+// URL is for a sub-directory (e.g. raw) which is always built from the document's key.
+func (s *Server) appendURL(b []byte, doc *haste.PasteResponse, p urlParts) []byte {
+	if doc.URL != "" && p.dir == "" {
+		if u, err := url.Parse(doc.URL); err == nil {
+			return append(append(b, documentURL(u, p)...), '\n')
+		}
+	}
+
+	b = append(b, s.haste.URL...)
+	b = append(b, '/')
+	b = append(b, p.dir...)
+	b = append(b, doc.Key...)
+	if p.ext != "" {
+		b = append(b, '.')
+		b = append(b, p.ext...)
+	}
+	if p.query != "" {
+		b = append(b, '?')
+		b = append(b, p.query...)
+	}
+	if p.fragment != "" {
+		b = append(b, '#')
+		b = append(b, p.fragment...)
+	}
+	return append(b, '\n')
+}
+
+// documentURL returns the URL of a document returned by the haste-server with the parts added.
+//
+// Any query parameters in the URL (e.g. a token added by the haste-server) are preserved, the
+// query of the parts is added after them.
+func documentURL(u *url.URL, p urlParts) string {
+	if p.ext != "" {
+		u.Path += "." + p.ext
+		if u.RawPath != "" {
+			u.RawPath += "." + p.ext
+		}
+	}
+	if p.query != "" {
+		if u.RawQuery != "" {
+			u.RawQuery += "&"
+		}
+		u.RawQuery += p.query
+	}
+	if p.fragment != "" {
+		u.Fragment, u.RawFragment = p.fragment, ""
+	}
+	return u.String()
+}
+
+// Actions taken for a paste when the client resets the connection while sending it.
+const (
+	resetActionUpload  = "upload"
+	resetActionDiscard = "discard"
+)
+
+// maxReadBufferSize is the maximum size of the buffer used for each read from a connection.
+const maxReadBufferSize = 64 * 1024
+
+// readBufferSize returns the size of the buffer used for each read from a connection.
+func readBufferSize() int {
+	return min(max(CLI.ReadBufferSize, 1), maxReadBufferSize)
+}
+
+// pasteLimit returns the maximum amount of data that will be accepted from a client.
+//
+// The limit is inclusive, a paste of exactly this many bytes is accepted.
+func pasteLimit() int {
+	if CLI.SplitLarge {
+		return CLI.SplitSize * CLI.SplitMaxDocuments
+	}
+	if CLI.BatchDelimiter != "" {
+		return CLI.Limit * CLI.BatchMaxDocuments
+	}
+	return CLI.Limit
+}
+
+// upload uploads each chunk to the haste-server as its own document, returning the documents in
+// order. If key is not empty, it is requested as the key of the document.
+func (s *Server) upload(ctx context.Context, key string, chunks [][]byte) ([]*haste.PasteResponse, error) {
+	docs := make([]*haste.PasteResponse, 0, len(chunks))
+	for _, chunk := range chunks {
+		var (
+			r   *haste.PasteResponse
+			err error
+		)
+		if key != "" {
+			r, err = s.haste.PasteWithKey(ctx, key, bytes.NewReader(chunk))
+		} else {
+			r, err = s.haste.Paste(ctx, bytes.NewReader(chunk))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if CLI.VerifyUpload {
+			if err := s.verify(ctx, r.Key, chunk); err != nil {
+				return nil, err
+			}
+		}
+		s.metrics.pastes.Add(1)
+		s.metrics.bytesUploaded.Add(uint64(len(chunk)))
+		docs = append(docs, r)
+	}
+	return docs, nil
+}
+
+// uploadReader uploads the contents of r to the haste-server as a single document.
+func (s *Server) uploadReader(ctx context.Context, r *io.SectionReader) ([]*haste.PasteResponse, error) {
+	doc, err := s.haste.Paste(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.pastes.Add(1)
+	s.metrics.bytesUploaded.Add(uint64(r.Size()))
+	return []*haste.PasteResponse{doc}, nil
+}
+
+// errUploadMismatch is returned when a document read back from the haste-server doesn't match
+// what was uploaded.
+var errUploadMismatch = errors.New("uploaded document does not match the sent data")
+
+// verify reads the document with the provided key back from the haste-server, ensuring it
+// matches the data that was uploaded.
+func (s *Server) verify(ctx context.Context, key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, CLI.VerifyUploadTimeout)
+	defer cancel()
+
+	// Read one byte past the expected length, so a longer document is detected without reading
+	// all of it.
+	b, err := s.haste.Raw(ctx, key, int64(len(data))+1)
+	if err != nil {
+		return fmt.Errorf("failed to read back document: %w", err)
+	}
+	if !bytes.Equal(b, data) {
+		return fmt.Errorf("%w (key %q)", errUploadMismatch, key)
+	}
+	return nil
+}
+
+// responseWriteTimeout is the maximum time spent writing a response, including any retries.
+const responseWriteTimeout = 1 * time.Second
+
+// writeResponse writes a response to the connection.
+//
+// If a write times out (e.g. due to a congested socket), the rest of the response is retried up
+// to `--response-write-retries` times before giving up. Every attempt shares the same deadline,
+// the time left before it is split evenly between the remaining attempts.
+func writeResponse(conn net.Conn, b []byte) error {
+	attempts := max(CLI.ResponseWriteRetries, 0) + 1
+	deadline := time.Now().Add(responseWriteTimeout)
+	var err error
+	for attempt := range attempts {
+		now := time.Now()
+		if err := conn.SetWriteDeadline(now.Add(deadline.Sub(now) / time.Duration(attempts-attempt))); err != nil {
+			return fmt.Errorf("failed to set write deadline: %w", err)
+		}
+		var n int
+		n, err = conn.Write(b)
+		if err == nil {
+			return nil
+		}
+		b = b[n:]
+
+		// Only a timeout is worth retrying, anything else means the client is gone.
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			return err
+		}
+	}
+	return err
+}
+
+// newConnID returns a new random ID for a connection, used to correlate its logs.
+func newConnID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// writeUsage writes `--usage-message` to a client that connected without sending anything, such
+// as someone connecting by hand. Nothing is written if no usage message is configured.
+//
+// The client may have already gone away (e.g. a health check), so any error is ignored.
+func writeUsage(conn net.Conn) {
+	if CLI.UsageMessage == "" {
+		return
+	}
+	msg := CLI.UsageMessage
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	_ = writeResponse(conn, []byte(msg))
+}
+
+// unknownRemoteAddr is used in place of a connection's remote address when it isn't available.
+const unknownRemoteAddr = "unknown"
+
+// remoteAddrString returns the remote address of a connection as a string.
+//
+// Some listener implementations (e.g. pipes) may return a nil remote address, in which case
+// unknownRemoteAddr is returned instead.
+func remoteAddrString(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return unknownRemoteAddr
+	}
+	return addr.String()
+}
+
+// logAddr returns remoteAddr as it should be logged, without the source port unless
+// `--log-source-port` is enabled.
+func logAddr(remoteAddr string) string {
+	if CLI.LogSourcePort {
+		return remoteAddr
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// reject records that the client at remoteAddr was rejected for the provided reason.
+func (s *Server) reject(remoteAddr, reason string) {
+	s.metrics.rejections.Add(1)
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return
+	}
+	s.rejections.Record(addrPort.Addr(), reason)
+}
+
+// submitSideEffect submits a best-effort task to run in the background, logging if the task
+// had to be dropped.
+func (s *Server) submitSideEffect(ctx context.Context, name string, task func()) {
+	if !s.sideEffects.Submit(task) {
+		slog.LogAttrs(ctx, slog.LevelWarn, "dropped side effect, queue is full", slog.String("side_effect", name))
+	}
+}
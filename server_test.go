@@ -0,0 +1,1608 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/kong"
+	"github.com/matthewpi/fiche/internal/haste"
+	"github.com/matthewpi/fiche/internal/logctx"
+	"github.com/matthewpi/fiche/internal/viewtoken"
+)
+
+// setFlags parses args into CLI for the duration of the test, any flag not in args uses its
+// default value.
+//
+// Tests using setFlags must not be run in parallel, as CLI is global.
+func setFlags(t testing.TB, args ...string) {
+	t.Helper()
+	if err := parseFlags(t, args...); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+}
+
+// parseFlags is like setFlags, but returns any error from parsing args.
+func parseFlags(t testing.TB, args ...string) error {
+	t.Helper()
+	saved := CLI
+	t.Cleanup(func() { CLI = saved })
+
+	parser, err := kong.New(&CLI, kong.Name("fiche"), kong.NamedMapper("limit", limitMapper()))
+	if err != nil {
+		t.Fatalf("failed to create parser: %v", err)
+	}
+	_, err = parser.Parse(args)
+	return err
+}
+
+// testHaste is a haste-server storing documents in memory.
+type testHaste struct {
+	mu   sync.Mutex
+	docs []string
+	// keys are the keys of the stored documents.
+	keys []string
+}
+
+// ServeHTTP satisfies the http.Handler interface.
+func (h *testHaste) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if k, ok := strings.CutPrefix(r.URL.Path, "/raw/"); ok && r.Method == http.MethodGet {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		i := slices.Index(h.keys, k)
+		if i < 0 {
+			http.Error(w, "document not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte(h.docs[i]))
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := "doc" + strconv.Itoa(len(h.docs)+1)
+	if k, ok := strings.CutPrefix(r.URL.Path, "/documents/"); ok {
+		if slices.Contains(h.keys, k) {
+			http.Error(w, "key is already taken", http.StatusConflict)
+			return
+		}
+		key = k
+	}
+	h.docs = append(h.docs, string(b))
+	h.keys = append(h.keys, key)
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"key":"` + key + `"}`))
+}
+
+// documents returns the documents stored by the haste-server.
+func (h *testHaste) documents() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.docs...)
+}
+
+// newTestServer returns a server using handler as its haste-server. If handler is nil, a
+// testHaste is used and returned.
+func newTestServer(t testing.TB, handler http.Handler) (*Server, *testHaste) {
+	t.Helper()
+	var h *testHaste
+	if handler == nil {
+		h = &testHaste{}
+		handler = h
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	c, err := haste.NewClient(srv.URL)
+	if err != nil {
+		t.Fatalf("failed to create haste client: %v", err)
+	}
+	return NewServer(nil, c), h
+}
+
+// roundTrip handles a single connection sending data to s, returning the response sent to the
+// client and the error returned by handle.
+func roundTrip(t *testing.T, s *Server, data string) (string, error) {
+	t.Helper()
+	return roundTripFunc(t, s, func(conn *net.TCPConn) error {
+		if _, err := conn.Write([]byte(data)); err != nil {
+			return err
+		}
+		return conn.CloseWrite()
+	})
+}
+
+// roundTripFunc handles a single connection to s, using send to send data on the client side of
+// the connection. The response sent to the client and the error returned by handle are returned.
+func roundTripFunc(t *testing.T, s *Server, send func(conn *net.TCPConn) error) (string, error) {
+	t.Helper()
+	return roundTripConn(t, s, nil, send)
+}
+
+// roundTripConn is like roundTripFunc, but the server's side of the connection is wrapped using
+// wrap (if not nil) before it is handled.
+func roundTripConn(t testing.TB, s *Server, wrap func(net.Conn) net.Conn, send func(conn *net.TCPConn) error) (string, error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		if wrap != nil {
+			conn = wrap(conn)
+		}
+		errCh <- s.handle(context.Background(), conn)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := send(conn.(*net.TCPConn)); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	res, _ := io.ReadAll(conn)
+
+	select {
+	case err := <-errCh:
+		return string(res), err
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for the connection to be handled")
+		return "", nil
+	}
+}
+
+func TestLogAddr(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		remoteAddr string
+		want       string
+	}{
+		{"ipv4", nil, "192.0.2.1:1234", "192.0.2.1:1234"},
+		{"ipv4 without port", []string{"--no-log-source-port"}, "192.0.2.1:1234", "192.0.2.1"},
+		{"ipv6 without port", []string{"--no-log-source-port"}, "[2001:db8::1]:1234", "2001:db8::1"},
+		{"unknown", []string{"--no-log-source-port"}, "unknown", "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			if got := logAddr(tt.remoteAddr); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHandle_LogSourcePort(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		port bool
+	}{
+		{name: "enabled", port: true},
+		{name: "disabled", args: []string{"--no-log-source-port"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, append([]string{"--log-format=json"}, tt.args...)...)
+			logs := captureLogs(t)
+			s, _ := newTestServer(t, nil)
+
+			if _, err := roundTrip(t, s, "hello"); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := make(map[string]string)
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				var entry struct {
+					Msg        string `json:"msg"`
+					RemoteAddr string `json:"remote_addr"`
+				}
+				if err := json.Unmarshal([]byte(line), &entry); err == nil && entry.RemoteAddr != "" {
+					got[entry.Msg] = entry.RemoteAddr
+				}
+			}
+			for _, msg := range []string{"new connection", "connection closed"} {
+				addr, ok := got[msg]
+				if !ok {
+					t.Fatalf("expected a %q log with the remote address, got %q", msg, logs.String())
+				}
+				host, _, err := net.SplitHostPort(addr)
+				if tt.port && (err != nil || host != "127.0.0.1") {
+					t.Errorf("expected %q to log the address with its port, got %q", msg, addr)
+				}
+				if !tt.port && addr != "127.0.0.1" {
+					t.Errorf("expected %q to log the address without its port, got %q", msg, addr)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteResponse_Deadline(t *testing.T) {
+	setFlags(t, "--response-write-retries=2")
+
+	t.Run("retries", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		// Only start reading after the first attempt has timed out.
+		done := make(chan []byte, 1)
+		go func() {
+			time.Sleep(responseWriteTimeout / 2)
+			b, _ := io.ReadAll(client)
+			done <- b
+		}()
+		if err := writeResponse(server, []byte("hello\n")); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		_ = server.Close()
+		if b := <-done; string(b) != "hello\n" {
+			t.Errorf("expected %q, got %q", "hello\n", b)
+		}
+	})
+
+	t.Run("single deadline", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+
+		start := time.Now()
+		err := writeResponse(server, []byte("hello\n"))
+		var netErr net.Error
+		if !errors.As(err, &netErr) || !netErr.Timeout() {
+			t.Errorf("expected a timeout, got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > responseWriteTimeout+responseWriteTimeout/2 {
+			t.Errorf("expected retries to share a single deadline, took %s", elapsed)
+		}
+	})
+}
+
+func TestShutdown_DrainsConnections(t *testing.T) {
+	setFlags(t, "--response-delay=300ms")
+	s, h := newTestServer(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s.listener = l
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run(ctx)
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	_ = conn.(*net.TCPConn).CloseWrite()
+
+	// Shut down while the response is being delayed.
+	for len(h.documents()) < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	_ = l.Close()
+	if err := <-runErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected Run to return context.Canceled, got %v", err)
+	}
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		t.Fatalf("failed to shutdown: %v", err)
+	}
+
+	res, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if want := s.haste.URL + "/doc1\n"; string(res) != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+}
+
+// nilAddrConn is a net.Conn without a remote address.
+type nilAddrConn struct {
+	net.Conn
+}
+
+// RemoteAddr satisfies the net.Conn interface.
+func (nilAddrConn) RemoteAddr() net.Addr {
+	return nil
+}
+
+func TestHandle_NilRemoteAddr(t *testing.T) {
+	setFlags(t, "--read-timeout=100ms", "--max-uploads-per-ip=1", "--response-delay=1ms", "--response-delay-scale")
+	s, h := newTestServer(t, nil)
+	s.uploads = newUploadLimiter(CLI.MaxUploadsPerIP)
+
+	if got := remoteAddrString(nilAddrConn{}); got != unknownRemoteAddr {
+		t.Errorf("expected %q, got %q", unknownRemoteAddr, got)
+	}
+
+	server, client := net.Pipe()
+	defer client.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.handle(context.Background(), nilAddrConn{Conn: server})
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to send data: %v", err)
+	}
+	res, _ := io.ReadAll(client)
+	if err := <-errCh; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := s.haste.URL + "/doc1\n"; string(res) != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+	if docs := h.documents(); len(docs) != 1 || docs[0] != "hello" {
+		t.Errorf("expected a single document, got %q", docs)
+	}
+}
+
+func TestHandle_ResponseTrailingNewline(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"enabled", nil, "/doc1\n"},
+		{"disabled", []string{"--no-response-trailing-newline"}, "/doc1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			s, _ := newTestServer(t, nil)
+			res, err := roundTrip(t, s, "hello")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := s.haste.URL + tt.want; res != want {
+				t.Errorf("expected response %q, got %q", want, res)
+			}
+		})
+	}
+}
+
+// readSizeConn is a net.Conn recording the largest buffer passed to Read.
+type readSizeConn struct {
+	net.Conn
+
+	maxRead int
+}
+
+// Read satisfies the io.Reader interface.
+func (c *readSizeConn) Read(b []byte) (int, error) {
+	c.maxRead = max(c.maxRead, len(b))
+	return c.Conn.Read(b)
+}
+
+func TestHandle_ReadBoundedByLimit(t *testing.T) {
+	setFlags(t, "--limit=100", "--read-buffer-size=65536", "--read-timeout=100ms")
+	s, h := newTestServer(t, nil)
+
+	for _, size := range []int{100, 101} {
+		server, client := net.Pipe()
+		conn := &readSizeConn{Conn: server}
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- s.handle(context.Background(), conn)
+		}()
+
+		// Send the paste using a single write, so it is received using a single read.
+		_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+		go func() {
+			_, _ = client.Write([]byte(strings.Repeat("a", size)))
+		}()
+		res, _ := io.ReadAll(client)
+		_ = client.Close()
+		err := <-errCh
+
+		if size <= CLI.Limit {
+			if err != nil {
+				t.Errorf("expected a paste of %d bytes to be accepted, got %v", size, err)
+			}
+		} else if !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("expected a paste of %d bytes to be rejected, got %v (response %q)", size, err, res)
+		}
+		// Never read more than one byte past the limit.
+		if conn.maxRead > CLI.Limit+1 {
+			t.Errorf("expected reads of at most %d bytes, got %d", CLI.Limit+1, conn.maxRead)
+		}
+	}
+	if docs := h.documents(); len(docs) != 1 {
+		t.Errorf("expected a single document, got %d", len(docs))
+	}
+}
+
+func TestHandle_LimitBoundary(t *testing.T) {
+	// The limit is inclusive, regardless of how the paste lines up with the read buffer.
+	for _, bufferSize := range []string{"16", "65536"} {
+		for _, tt := range []struct {
+			size     int
+			accepted bool
+		}{
+			{size: 99, accepted: true},
+			{size: 100, accepted: true},
+			{size: 101, accepted: false},
+		} {
+			t.Run(bufferSize+"/"+strconv.Itoa(tt.size), func(t *testing.T) {
+				setFlags(t, "--limit=100", "--read-buffer-size="+bufferSize)
+				s, h := newTestServer(t, nil)
+
+				data := strings.Repeat("a", tt.size)
+				res, err := roundTrip(t, s, data)
+				if !tt.accepted {
+					if !errors.Is(err, ErrLimitExceeded) {
+						t.Errorf("expected ErrLimitExceeded, got %v", err)
+					}
+					if want := "Pastes may not exceed 100 bytes of data"; res != want {
+						t.Errorf("expected response %q, got %q", want, res)
+					}
+					if docs := h.documents(); len(docs) > 0 {
+						t.Errorf("expected no documents to be uploaded, got %d", len(docs))
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if docs := h.documents(); !slices.Equal(docs, []string{data}) {
+					t.Errorf("expected the whole paste to be uploaded, got %d documents", len(docs))
+				}
+			})
+		}
+	}
+}
+
+func TestReadBufferSize(t *testing.T) {
+	for _, tt := range []struct {
+		size string
+		want int
+	}{
+		{"0", 1},
+		{"1024", 1024},
+		{"1048576", maxReadBufferSize},
+	} {
+		setFlags(t, "--read-buffer-size="+tt.size)
+		if got := readBufferSize(); got != tt.want {
+			t.Errorf("expected a read buffer size of %d for %s, got %d", tt.want, tt.size, got)
+		}
+	}
+}
+
+func TestHandle_AutoExtension(t *testing.T) {
+	setFlags(t, "--auto-extension")
+	s, _ := newTestServer(t, nil)
+
+	res, err := roundTrip(t, s, "package main\n")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := s.haste.URL + "/doc1.go\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+
+	// Nothing is appended if the language isn't detected and there is no default.
+	res, err = roundTrip(t, s, "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := s.haste.URL + "/doc2\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+}
+
+func TestHandle_SniffDefault(t *testing.T) {
+	setFlags(t, "--auto-extension", "--sniff-default=log")
+	s, _ := newTestServer(t, nil)
+
+	res, err := roundTrip(t, s, "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := s.haste.URL + "/doc1.log\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+}
+
+func TestHandle_AllowedContentTypes(t *testing.T) {
+	setFlags(t, "--allowed-content-types=text/*")
+	s, h := newTestServer(t, nil)
+
+	if _, err := roundTrip(t, s, "hello world"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	res, err := roundTrip(t, s, "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected ErrRejected, got %v", err)
+	}
+	if want := "Pastes of type image/png are not allowed\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+	if docs := h.documents(); len(docs) != 1 || docs[0] != "hello world" {
+		t.Errorf("expected only the text to be uploaded, got %q", docs)
+	}
+}
+
+func TestHandle_UnresolvableUpstream(t *testing.T) {
+	setFlags(t)
+	c, err := haste.NewClient("http://fiche.invalid")
+	if err != nil {
+		t.Fatalf("failed to create haste client: %v", err)
+	}
+	s := NewServer(nil, c)
+
+	res, err := roundTrip(t, s, "hello")
+	if !errors.Is(err, ErrUpstream) {
+		t.Errorf("expected ErrUpstream, got %v", err)
+	}
+	if want := "Backend unavailable, please try again later\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+}
+
+func TestHandle_ClientSideEncrypt(t *testing.T) {
+	setFlags(t, "--client-side-encrypt")
+	s, h := newTestServer(t, nil)
+
+	res, err := roundTrip(t, s, "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	url, fragment, ok := strings.Cut(strings.TrimSuffix(res, "\n"), "#")
+	if !ok || url != s.haste.URL+"/doc1" || !strings.HasPrefix(fragment, "key=") {
+		t.Errorf("expected the url to carry the key in its fragment, got %q", res)
+	}
+	docs := h.documents()
+	if len(docs) != 1 || strings.Contains(docs[0], "hello") {
+		t.Errorf("expected a single encrypted document, got %q", docs)
+	}
+	if _, err := base64.StdEncoding.DecodeString(docs[0]); err != nil {
+		t.Errorf("expected the document to be base64 encoded, got %v", err)
+	}
+}
+
+func TestHandle_ViewToken(t *testing.T) {
+	setFlags(t, "--view-token-secret=secret", "--view-token-ttl=1h")
+	s, _ := newTestServer(t, nil)
+
+	res, err := roundTrip(t, s, "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	u, err := url.Parse(strings.TrimSuffix(res, "\n"))
+	if err != nil {
+		t.Fatalf("failed to parse response %q: %v", res, err)
+	}
+	token := u.Query().Get(viewtoken.QueryParam)
+	expiry, _, _ := strings.Cut(token, ".")
+	expires, err := strconv.ParseInt(expiry, 10, 64)
+	if err != nil {
+		t.Fatalf("expected a token in the url, got %q", res)
+	}
+	if d := time.Until(time.Unix(expires, 0)); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("expected the token to expire in an hour, expires in %s", d)
+	}
+}
+
+// panicListener is a net.Listener whose first accepted connection panics when read from.
+type panicListener struct {
+	net.Listener
+	once sync.Once
+}
+
+func (l *panicListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	panicked := false
+	l.once.Do(func() { panicked = true })
+	if panicked {
+		return panicConn{conn}, nil
+	}
+	return conn, nil
+}
+
+// panicConn is a net.Conn that panics when read from.
+type panicConn struct {
+	net.Conn
+}
+
+func (panicConn) Read([]byte) (int, error) {
+	panic("injected panic")
+}
+
+func TestRun_RecoversFromPanic(t *testing.T) {
+	setFlags(t, "--log-format=json")
+	logs := captureLogs(t)
+	s, _ := newTestServer(t, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s.listener = &panicListener{Listener: l}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run(ctx)
+	}()
+
+	send := func() string {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		_, _ = conn.Write([]byte("hello"))
+		_ = conn.(*net.TCPConn).CloseWrite()
+		res, _ := io.ReadAll(conn)
+		return string(res)
+	}
+
+	// The connection that panicked is closed without a response.
+	if res := send(); res != "" {
+		t.Errorf("expected no response, got %q", res)
+	}
+	// The server keeps handling other connections.
+	if res, want := send(), s.haste.URL+"/doc1\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+
+	cancel()
+	_ = l.Close()
+	<-runErr
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shutdown: %v", err)
+	}
+	if !strings.Contains(logs.String(), `"msg":"panic while handling connection","panic":"injected panic","stack":`) {
+		t.Errorf("expected the panic to be logged with its stack, got %q", logs.String())
+	}
+}
+
+func TestHandle_MaxTotalPastes(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		shutdown bool
+	}{
+		{
+			name: "reject",
+			args: []string{"--max-total-pastes=2"},
+		},
+		{
+			name:     "shutdown",
+			args:     []string{"--max-total-pastes=2", "--shutdown-after-max"},
+			shutdown: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			s, h := newTestServer(t, nil)
+			s.rejections = newRejectionStats()
+			var stopped atomic.Int64
+			s.stop = func() { stopped.Add(1) }
+
+			for i := range 2 {
+				if _, err := roundTrip(t, s, "hello"); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if n := stopped.Load(); i == 0 && n != 0 {
+					t.Errorf("expected the server to keep running before the cap, stopped %d times", n)
+				}
+			}
+			want := int64(0)
+			if tt.shutdown {
+				want = 1
+			}
+			if n := stopped.Load(); n != want {
+				t.Errorf("expected the server to be stopped %d times, got %d", want, n)
+			}
+
+			res, err := roundTripFunc(t, s, func(conn *net.TCPConn) error {
+				// The connection is rejected before any data is read.
+				_, _ = conn.Write([]byte("hello"))
+				_ = conn.CloseWrite()
+				return nil
+			})
+			if !errors.Is(err, ErrRejected) {
+				t.Errorf("expected ErrRejected, got %v", err)
+			}
+			if res != maxTotalPastesMessage {
+				t.Errorf("expected response %q, got %q", maxTotalPastesMessage, res)
+			}
+			if docs := h.documents(); len(docs) != 2 {
+				t.Errorf("expected 2 documents, got %d", len(docs))
+			}
+			if n := s.metrics.rejections.Load(); n != 1 {
+				t.Errorf("expected 1 rejection, got %d", n)
+			}
+			prefixes := s.rejections.Flush(1)
+			if len(prefixes) != 1 || prefixes[0].Reasons[rejectReasonMaxTotal] != 1 {
+				t.Errorf("expected the rejection to be recorded for its prefix, got %+v", prefixes)
+			}
+		})
+	}
+}
+
+func TestHandle_MaxTotalPastes_FailedUpload(t *testing.T) {
+	setFlags(t, "--max-total-pastes=1")
+	var fail atomic.Bool
+	fail.Store(true)
+	h := &testHaste{}
+	s, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+
+	// Failed uploads don't count towards the cap.
+	if _, err := roundTrip(t, s, "hello"); !errors.Is(err, ErrUpstream) {
+		t.Fatalf("expected ErrUpstream, got %v", err)
+	}
+	fail.Store(false)
+	if _, err := roundTrip(t, s, "hello"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestHandle_MaxTotalPastes_ShutdownAfterCreated(t *testing.T) {
+	setFlags(t, "--max-total-pastes=2", "--shutdown-after-max")
+	h := &testHaste{}
+	var requests atomic.Int64
+	blocked, release := make(chan struct{}), make(chan struct{})
+	s, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first upload is held until the second one has completed, then fails.
+		if requests.Add(1) == 1 {
+			close(blocked)
+			<-release
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	}))
+	var stopped atomic.Int64
+	s.stop = func() { stopped.Add(1) }
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := roundTrip(t, s, "first")
+		errCh <- err
+	}()
+	<-blocked
+
+	// The cap has been reached by reservations, but only one paste has been created.
+	if _, err := roundTrip(t, s, "second"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	close(release)
+	if err := <-errCh; !errors.Is(err, ErrUpstream) {
+		t.Fatalf("expected ErrUpstream, got %v", err)
+	}
+	if n := stopped.Load(); n != 0 {
+		t.Fatalf("expected the server to keep running, stopped %d times", n)
+	}
+
+	if _, err := roundTrip(t, s, "third"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n := stopped.Load(); n != 1 {
+		t.Errorf("expected the server to be stopped once, got %d", n)
+	}
+}
+
+func TestHandle_Identify(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		data string
+		urls []string
+	}{
+		{
+			name: "single document",
+			args: []string{"--identify"},
+			data: "hello",
+			urls: []string{"/doc1"},
+		},
+		{
+			name: "batch",
+			args: []string{"--identify", "--batch-delimiter=---"},
+			data: "hello\n---\nworld",
+			urls: []string{"/doc1", "/doc2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			s, _ := newTestServer(t, nil)
+
+			res, err := roundTrip(t, s, tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			lines := strings.Split(strings.TrimSuffix(res, "\n"), "\n")
+			if want := "# fiche " + getVersion(); lines[0] != want {
+				t.Errorf("expected the first line to be %q, got %q", want, lines[0])
+			}
+			for i, u := range tt.urls {
+				if want := s.haste.URL + u; len(lines) <= i+1 || lines[i+1] != want {
+					t.Errorf("expected line %d to be %q, got %q", i+2, want, res)
+				}
+			}
+			if len(lines) != len(tt.urls)+1 {
+				t.Errorf("expected %d lines, got %q", len(tt.urls)+1, res)
+			}
+		})
+	}
+
+	// The identity line is only sent when enabled.
+	setFlags(t)
+	s, _ := newTestServer(t, nil)
+	res, err := roundTrip(t, s, "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.HasPrefix(res, "#") {
+		t.Errorf("expected no identity line, got %q", res)
+	}
+}
+
+// emptyReadConn is a net.Conn whose reads return no data and no error, emptyReads times before
+// reading from the underlying connection (or forever if emptyReads is negative).
+type emptyReadConn struct {
+	net.Conn
+
+	emptyReads int
+	reads      int
+}
+
+// Read satisfies the io.Reader interface.
+func (c *emptyReadConn) Read(b []byte) (int, error) {
+	if c.emptyReads < 0 || c.reads < c.emptyReads {
+		c.reads++
+		return 0, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func TestHandle_EmptyReads(t *testing.T) {
+	tests := []struct {
+		name       string
+		emptyReads int
+		err        error
+		reads      int
+	}{
+		{
+			name:       "before data",
+			emptyReads: maxConsecutiveEmptyReads - 1,
+			reads:      maxConsecutiveEmptyReads - 1,
+		},
+		{
+			name:       "forever",
+			emptyReads: -1,
+			err:        io.ErrNoProgress,
+			reads:      maxConsecutiveEmptyReads,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, "--read-timeout=100ms")
+			s, h := newTestServer(t, nil)
+
+			server, client := net.Pipe()
+			defer client.Close()
+			conn := &emptyReadConn{Conn: server, emptyReads: tt.emptyReads}
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- s.handle(context.Background(), conn)
+				_ = server.Close()
+			}()
+
+			_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+			if tt.err == nil {
+				if _, err := client.Write([]byte("hello")); err != nil {
+					t.Fatalf("failed to send data: %v", err)
+				}
+			}
+			res, _ := io.ReadAll(client)
+			if err := <-errCh; !errors.Is(err, tt.err) {
+				t.Errorf("expected error %v, got %v", tt.err, err)
+			}
+			if conn.reads != tt.reads {
+				t.Errorf("expected %d empty reads, got %d", tt.reads, conn.reads)
+			}
+			if tt.err != nil {
+				return
+			}
+			if want := s.haste.URL + "/doc1\n"; string(res) != want {
+				t.Errorf("expected response %q, got %q", want, res)
+			}
+			if docs := h.documents(); !slices.Equal(docs, []string{"hello"}) {
+				t.Errorf("expected the paste to be uploaded, got %q", docs)
+			}
+		})
+	}
+}
+
+// readResult is the result of a single call to Read.
+type readResult struct {
+	data string
+	err  error
+}
+
+// scriptedConn is a net.Conn whose reads return the provided results in order, writes go to the
+// underlying connection.
+type scriptedConn struct {
+	net.Conn
+
+	reads []readResult
+}
+
+// Read satisfies the io.Reader interface.
+func (c *scriptedConn) Read(b []byte) (int, error) {
+	if len(c.reads) < 1 {
+		return 0, io.EOF
+	}
+	r := c.reads[0]
+	c.reads = c.reads[1:]
+	return copy(b, r.data), r.err
+}
+
+func TestHandle_EOF(t *testing.T) {
+	tests := []struct {
+		name  string
+		reads []readResult
+	}{
+		{
+			name:  "data with eof",
+			reads: []readResult{{data: "hello", err: io.EOF}},
+		},
+		{
+			name:  "data then eof",
+			reads: []readResult{{data: "hello"}, {err: io.EOF}},
+		},
+		{
+			name:  "split data with eof",
+			reads: []readResult{{data: "hel"}, {data: "lo", err: io.EOF}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t)
+			s, h := newTestServer(t, nil)
+
+			server, client := net.Pipe()
+			defer client.Close()
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- s.handle(context.Background(), &scriptedConn{Conn: server, reads: tt.reads})
+				_ = server.Close()
+			}()
+
+			_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+			res, _ := io.ReadAll(client)
+			if err := <-errCh; err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if want := s.haste.URL + "/doc1\n"; string(res) != want {
+				t.Errorf("expected response %q, got %q", want, res)
+			}
+			if docs := h.documents(); !slices.Equal(docs, []string{"hello"}) {
+				t.Errorf("expected the paste to be uploaded, got %q", docs)
+			}
+		})
+	}
+}
+
+func TestHandle_Links(t *testing.T) {
+	tests := []struct {
+		name  string
+		args  []string
+		data  string
+		lines []string
+	}{
+		{
+			name:  "default",
+			data:  "hello",
+			lines: []string{"/doc1"},
+		},
+		{
+			name:  "all",
+			args:  []string{"--links=viewer,raw,download"},
+			data:  "hello",
+			lines: []string{"viewer: /doc1", "raw: /raw/doc1", "download: /raw/doc1.txt"},
+		},
+		{
+			name:  "order",
+			args:  []string{"--links=download,viewer"},
+			data:  "hello",
+			lines: []string{"download: /raw/doc1.txt", "viewer: /doc1"},
+		},
+		{
+			name:  "extension",
+			args:  []string{"--links=viewer,raw,download", "--auto-extension"},
+			data:  "package main\n",
+			lines: []string{"viewer: /doc1.go", "raw: /raw/doc1", "download: /raw/doc1.go"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			s, _ := newTestServer(t, nil)
+
+			res, err := roundTrip(t, s, tt.data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			var want string
+			for _, line := range tt.lines {
+				label, path, ok := strings.Cut(line, " ")
+				if !ok {
+					label, path = "", line
+				} else {
+					label += " "
+				}
+				want += label + s.haste.URL + path + "\n"
+			}
+			if res != want {
+				t.Errorf("expected response %q, got %q", want, res)
+			}
+		})
+	}
+
+	if err := parseFlags(t, "--links=html"); err == nil {
+		t.Error("expected an unknown link format to be rejected")
+	}
+}
+
+func TestHandle_VerifyUpload(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(string) string
+		err     error
+	}{
+		{
+			name: "match",
+		},
+		{
+			name:    "modified",
+			corrupt: func(doc string) string { return strings.ToUpper(doc) },
+			err:     ErrUpstream,
+		},
+		{
+			name:    "truncated",
+			corrupt: func(doc string) string { return doc[:len(doc)-1] },
+			err:     ErrUpstream,
+		},
+		{
+			name:    "extended",
+			corrupt: func(doc string) string { return doc + strings.Repeat("!", 1024) },
+			err:     ErrUpstream,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, "--verify-upload")
+			h := &testHaste{}
+			s, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				k, ok := strings.CutPrefix(r.URL.Path, "/raw/")
+				if !ok || tt.corrupt == nil {
+					h.ServeHTTP(w, r)
+					return
+				}
+				h.mu.Lock()
+				doc := h.docs[slices.Index(h.keys, k)]
+				h.mu.Unlock()
+				_, _ = w.Write([]byte(tt.corrupt(doc)))
+			}))
+
+			res, err := roundTrip(t, s, "hello")
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if tt.err == nil {
+				if want := s.haste.URL + "/doc1\n"; res != want {
+					t.Errorf("expected response %q, got %q", want, res)
+				}
+				return
+			}
+			if !errors.Is(err, errUploadMismatch) {
+				t.Errorf("expected errUploadMismatch, got %v", err)
+			}
+			if want := "The paste was corrupted by the backend, please try again later\n"; res != want {
+				t.Errorf("expected response %q, got %q", want, res)
+			}
+		})
+	}
+}
+
+func TestHandle_UpstreamAuthFailure(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden} {
+		t.Run(strconv.Itoa(status), func(t *testing.T) {
+			setFlags(t, "--log-format=json")
+			logs := captureLogs(t)
+			s, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				http.Error(w, "invalid token", status)
+			}))
+
+			res, err := roundTrip(t, s, "hello")
+			if !errors.Is(err, ErrUpstream) {
+				t.Errorf("expected ErrUpstream, got %v", err)
+			}
+			var statusErr haste.StatusError
+			if !errors.As(err, &statusErr) || statusErr.StatusCode != status {
+				t.Errorf("expected a StatusError with status %d, got %v", status, err)
+			}
+			if want := "Backend misconfigured, please try again later\n"; res != want {
+				t.Errorf("expected response %q, got %q", want, res)
+			}
+			want := `"msg":"upstream authentication failed, check the haste-server's credentials","status":` + strconv.Itoa(status)
+			if !strings.Contains(logs.String(), want) {
+				t.Errorf("expected the operator to be told to check the credentials, got %q", logs.String())
+			}
+		})
+	}
+}
+
+// countingConn is a net.Conn counting the reads that returned data.
+type countingConn struct {
+	net.Conn
+
+	reads atomic.Int64
+}
+
+// Read satisfies the io.Reader interface.
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.reads.Add(1)
+	}
+	return n, err
+}
+
+// sendFragmented sends data to conn in fragments of size bytes, pausing between each.
+func sendFragmented(data string, size int) func(conn *net.TCPConn) error {
+	return func(conn *net.TCPConn) error {
+		for len(data) > 0 {
+			n := min(len(data), size)
+			if _, err := conn.Write([]byte(data[:n])); err != nil {
+				return err
+			}
+			data = data[n:]
+			time.Sleep(2 * time.Millisecond)
+		}
+		return conn.CloseWrite()
+	}
+}
+
+// fragmentedReads returns the number of reads used to handle a fragmented paste.
+func fragmentedReads(t testing.TB, s *Server, data string) int64 {
+	t.Helper()
+	var conn *countingConn
+	wrap := func(c net.Conn) net.Conn {
+		conn = &countingConn{Conn: c}
+		return conn
+	}
+	if _, err := roundTripConn(t, s, wrap, sendFragmented(data, 10)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return conn.reads.Load()
+}
+
+func TestHandle_ReadCoalesce(t *testing.T) {
+	data := strings.Repeat("a", 200)
+
+	setFlags(t)
+	s, _ := newTestServer(t, nil)
+	uncoalesced := fragmentedReads(t, s, data)
+
+	setFlags(t, "--read-coalesce=50ms")
+	s, h := newTestServer(t, nil)
+	coalesced := fragmentedReads(t, s, data)
+
+	if coalesced*2 > uncoalesced {
+		t.Errorf("expected coalescing to reduce reads, got %d reads with coalescing and %d without", coalesced, uncoalesced)
+	}
+	if docs := h.documents(); !slices.Equal(docs, []string{data}) {
+		t.Errorf("expected the coalesced paste to be uploaded intact, got %q", docs)
+	}
+}
+
+func BenchmarkHandle_ReadCoalesce(b *testing.B) {
+	data := strings.Repeat("a", 200)
+	for _, coalesce := range []string{"0s", "10ms"} {
+		b.Run(coalesce, func(b *testing.B) {
+			setFlags(b, "--read-coalesce="+coalesce)
+			s, _ := newTestServer(b, nil)
+			var reads int64
+			for range b.N {
+				reads += fragmentedReads(b, s, data)
+			}
+			b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+// deadlineConn is a net.Conn recording the read timeouts it was given.
+type deadlineConn struct {
+	net.Conn
+
+	timeouts []time.Duration
+}
+
+// SetReadDeadline satisfies the net.Conn interface.
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.timeouts = append(c.timeouts, time.Until(t).Round(time.Second))
+	return c.Conn.SetReadDeadline(t)
+}
+
+func TestHandle_FirstByteTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		timeouts []time.Duration
+	}{
+		{
+			name:     "read timeout",
+			args:     []string{"--read-timeout=5s"},
+			timeouts: []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:     "first byte timeout",
+			args:     []string{"--read-timeout=5s", "--first-byte-timeout=1m"},
+			timeouts: []time.Duration{time.Minute, 5 * time.Second, 5 * time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			s, _ := newTestServer(t, nil)
+
+			server, client := net.Pipe()
+			defer client.Close()
+			conn := &deadlineConn{Conn: &scriptedConn{
+				Conn:  server,
+				reads: []readResult{{data: "hel"}, {data: "lo"}, {err: io.EOF}},
+			}}
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- s.handle(context.Background(), conn)
+				_ = server.Close()
+			}()
+
+			_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+			_, _ = io.ReadAll(client)
+			if err := <-errCh; err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(conn.timeouts) < len(tt.timeouts) || !slices.Equal(conn.timeouts[:len(tt.timeouts)], tt.timeouts) {
+				t.Errorf("expected read timeouts %v, got %v", tt.timeouts, conn.timeouts)
+			}
+		})
+	}
+}
+
+func TestHandle_ClientTraceID(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		data string
+		want string
+	}{
+		{
+			name: "accepted",
+			args: []string{"--accept-client-trace-id"},
+			data: "!trace-id client-123\nhello",
+			want: "client-123",
+		},
+		{
+			name: "invalid",
+			args: []string{"--accept-client-trace-id"},
+			data: "!trace-id client 123!\nhello",
+			want: "generated",
+		},
+		{
+			name: "disabled",
+			data: "!trace-id client-123\nhello",
+			want: "generated",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, append([]string{"--log-format=json"}, tt.args...)...)
+			logs := captureLogs(t)
+			s, _ := newTestServer(t, nil)
+
+			server, client := net.Pipe()
+			defer client.Close()
+			ctx := logctx.With(context.Background(), slog.String("conn_id", "generated"))
+			errCh := make(chan error, 1)
+			go func() {
+				errCh <- s.handle(ctx, &scriptedConn{Conn: server, reads: []readResult{{data: tt.data, err: io.EOF}}})
+				_ = server.Close()
+			}()
+			_ = client.SetDeadline(time.Now().Add(10 * time.Second))
+			_, _ = io.ReadAll(client)
+			if err := <-errCh; err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// The connection closed log is written last, after the directives were parsed.
+			var closed struct {
+				ConnID string `json:"conn_id"`
+			}
+			for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				if strings.Contains(line, `"msg":"connection closed"`) {
+					_ = json.Unmarshal([]byte(line), &closed)
+				}
+			}
+			if closed.ConnID != tt.want {
+				t.Errorf("expected conn_id %q, got %q in %q", tt.want, closed.ConnID, logs.String())
+			}
+		})
+	}
+}
+
+// brokenPipeConn is a scriptedConn for a client that disconnects after sending its data, so
+// writes to it fail.
+type brokenPipeConn struct {
+	scriptedConn
+}
+
+// Write satisfies the io.Writer interface.
+func (*brokenPipeConn) Write([]byte) (int, error) {
+	return 0, syscall.EPIPE
+}
+
+func TestHandle_ClientGone(t *testing.T) {
+	setFlags(t, "--log-format=json", "--client-side-encrypt")
+	logs := captureLogs(t)
+	s, h := newTestServer(t, nil)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	conn := &brokenPipeConn{scriptedConn{Conn: server, reads: []readResult{{data: "hello", err: io.EOF}}}}
+	if err := s.handle(context.Background(), conn); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if docs := h.documents(); len(docs) != 1 {
+		t.Fatalf("expected 1 document, got %q", docs)
+	}
+
+	var entry struct {
+		Keys []string `json:"keys"`
+		Err  string   `json:"err"`
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if strings.Contains(line, `"msg":"paste created but the client disconnected before receiving its url"`) {
+			_ = json.Unmarshal([]byte(line), &entry)
+		}
+	}
+	if !slices.Equal(entry.Keys, []string{"doc1"}) {
+		t.Errorf("expected keys %q, got %q in %q", []string{"doc1"}, entry.Keys, logs.String())
+	}
+	if entry.Err == "" {
+		t.Error("expected the write error to be logged")
+	}
+	// The URL contains the encryption key, which must never be logged.
+	if strings.Contains(logs.String(), s.haste.URL+"/doc1") || strings.Contains(logs.String(), "#") {
+		t.Errorf("expected the url not to be logged, got %q", logs.String())
+	}
+}
+
+func TestHandle_ConnectionReset(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	tests := []struct {
+		name    string
+		args    []string
+		reads   []readResult
+		wantErr error
+		want    []string
+	}{
+		{
+			name:  "upload",
+			reads: []readResult{{data: "hello"}, {err: reset}},
+			want:  []string{"hello"},
+		},
+		{
+			name:    "discard",
+			args:    []string{"--reset-action=discard"},
+			reads:   []readResult{{data: "hello"}, {err: reset}},
+			wantErr: ErrConnectionReset,
+		},
+		{
+			name:  "no data",
+			reads: []readResult{{err: reset}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			s, h := newTestServer(t, nil)
+
+			server, client := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			// A client that reset the connection can't receive a response either.
+			err := s.handle(context.Background(), &brokenPipeConn{scriptedConn{Conn: server, reads: tt.reads}})
+			if tt.wantErr == nil && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("expected %v, got %v", tt.wantErr, err)
+			}
+			if docs := h.documents(); !slices.Equal(docs, tt.want) {
+				t.Errorf("expected documents %q, got %q", tt.want, docs)
+			}
+		})
+	}
+}
+
+func TestHandle_UsageMessage(t *testing.T) {
+	closeWrite := func(conn *net.TCPConn) error { return conn.CloseWrite() }
+	sendNothing := func(*net.TCPConn) error { return nil }
+	tests := []struct {
+		name string
+		args []string
+		send func(conn *net.TCPConn) error
+		want string
+	}{
+		{
+			name: "closed",
+			args: []string{"--usage-message=usage: echo hello | nc example.com 9999"},
+			send: closeWrite,
+			want: "usage: echo hello | nc example.com 9999\n",
+		},
+		{
+			name: "timed out",
+			args: []string{"--usage-message=usage: echo hello | nc example.com 9999\n"},
+			send: sendNothing,
+			want: "usage: echo hello | nc example.com 9999\n",
+		},
+		{
+			name: "disabled",
+			send: closeWrite,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, append([]string{"--read-timeout=100ms"}, tt.args...)...)
+			s, h := newTestServer(t, nil)
+
+			res, err := roundTripFunc(t, s, tt.send)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if res != tt.want {
+				t.Errorf("expected response %q, got %q", tt.want, res)
+			}
+			if docs := h.documents(); len(docs) > 0 {
+				t.Errorf("expected no documents to be uploaded, got %q", docs)
+			}
+		})
+	}
+}
+
+func TestDocumentURL(t *testing.T) {
+	tests := []struct {
+		name  string
+		url   string
+		parts urlParts
+		want  string
+	}{
+		{
+			name: "no parts",
+			url:  "https://cdn.example/p/abc?token=xyz",
+			want: "https://cdn.example/p/abc?token=xyz",
+		},
+		{
+			name:  "extension",
+			url:   "https://cdn.example/p/abc?token=xyz",
+			parts: urlParts{ext: "go"},
+			want:  "https://cdn.example/p/abc.go?token=xyz",
+		},
+		{
+			name:  "query",
+			url:   "https://cdn.example/p/abc?token=xyz",
+			parts: urlParts{query: "t=1"},
+			want:  "https://cdn.example/p/abc?token=xyz&t=1",
+		},
+		{
+			name:  "fragment",
+			url:   "https://cdn.example/p/abc?token=xyz",
+			parts: urlParts{fragment: "key"},
+			want:  "https://cdn.example/p/abc?token=xyz#key",
+		},
+		{
+			name:  "encoded",
+			url:   "https://cdn.example/p/a%2Fb?token=x%20y",
+			parts: urlParts{ext: "go"},
+			want:  "https://cdn.example/p/a%2Fb.go?token=x%20y",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatalf("failed to parse url: %v", err)
+			}
+			if got := documentURL(u, tt.parts); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHandle_LocationQuery(t *testing.T) {
+	setFlags(t)
+	s, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Location", "/docs/abc?token=xyz")
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	res, err := roundTrip(t, s, "hello")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := s.haste.URL + "/docs/abc?token=xyz\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+}
@@ -0,0 +1,42 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyShutdown returns a context that is canceled when the process receives `SIGINT` or
+// `SIGTERM`, starting a graceful shutdown.
+//
+// A second `SIGINT` or `SIGTERM`, or any `SIGQUIT`, immediately exits the process without
+// waiting for in-flight connections.
+func notifyShutdown(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	go func() {
+		graceful := false
+		for sig := range signals {
+			attr := slog.String("signal", sig.String())
+			if sig == syscall.SIGQUIT || graceful {
+				slog.LogAttrs(ctx, slog.LevelWarn, "received signal, exiting immediately", attr)
+				os.Exit(1)
+			}
+			slog.LogAttrs(ctx, slog.LevelInfo, "received signal, shutting down gracefully", attr)
+			graceful = true
+			cancel()
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
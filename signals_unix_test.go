@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+//go:build !windows
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestNotifyShutdownHelper is a helper test run using helperCommand by TestNotifyShutdown, as
+// signals may exit the process.
+//
+// It reports when it is ready and when the context is canceled on stdout, then "drains" until
+// stdin is closed.
+func TestNotifyShutdownHelper(t *testing.T) {
+	if !isHelperProcess(t) {
+		return
+	}
+	ctx, cancel := notifyShutdown(context.Background())
+	defer cancel()
+
+	fmt.Println("ready")
+	<-ctx.Done()
+	fmt.Println("draining")
+	_, _ = io.Copy(io.Discard, os.Stdin)
+	os.Exit(0)
+}
+
+func TestNotifyShutdown(t *testing.T) {
+	tests := []struct {
+		name     string
+		signals  []syscall.Signal
+		graceful bool
+	}{
+		{
+			name:     "sigterm",
+			signals:  []syscall.Signal{syscall.SIGTERM},
+			graceful: true,
+		},
+		{
+			name:     "sigint",
+			signals:  []syscall.Signal{syscall.SIGINT},
+			graceful: true,
+		},
+		{
+			name:    "second signal",
+			signals: []syscall.Signal{syscall.SIGTERM, syscall.SIGINT},
+		},
+		{
+			name:    "sigquit",
+			signals: []syscall.Signal{syscall.SIGQUIT},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			cmd := helperCommand(ctx, "TestNotifyShutdownHelper")
+			stdin, err := cmd.StdinPipe()
+			if err != nil {
+				t.Fatalf("failed to create stdin pipe: %v", err)
+			}
+			defer stdin.Close()
+			stdout, err := cmd.StdoutPipe()
+			if err != nil {
+				t.Fatalf("failed to create stdout pipe: %v", err)
+			}
+			if err := cmd.Start(); err != nil {
+				t.Fatalf("failed to start helper: %v", err)
+			}
+			lines := bufio.NewScanner(stdout)
+			expectLine := func(want string) {
+				t.Helper()
+				if !lines.Scan() || lines.Text() != want {
+					t.Fatalf("expected %q from helper, got %q", want, lines.Text())
+				}
+			}
+			expectLine("ready")
+
+			for i, sig := range tt.signals {
+				if err := cmd.Process.Signal(sig); err != nil {
+					t.Fatalf("failed to send %s: %v", sig, err)
+				}
+				if i == 0 && sig != syscall.SIGQUIT {
+					expectLine("draining")
+				}
+			}
+			if tt.graceful {
+				// Finish draining.
+				_ = stdin.Close()
+			}
+
+			err = cmd.Wait()
+			var exitErr *exec.ExitError
+			switch {
+			case tt.graceful && err != nil:
+				t.Errorf("expected the helper to drain and exit cleanly, got %v", err)
+			case !tt.graceful && (!errors.As(err, &exitErr) || exitErr.ExitCode() != 1):
+				t.Errorf("expected the helper to exit immediately with status 1, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,52 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestGetListener_ReuseAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want int
+	}{
+		{"enabled", nil, 1},
+		{"disabled", []string{"--no-reuse-addr"}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, append([]string{"--listen=127.0.0.1:0"}, tt.args...)...)
+			l, err := getListener(context.Background())
+			if err != nil {
+				t.Fatalf("failed to get listener: %v", err)
+			}
+			defer l.Close()
+
+			rc, err := l.(*net.TCPListener).SyscallConn()
+			if err != nil {
+				t.Fatalf("failed to get raw connection: %v", err)
+			}
+			var (
+				v      int
+				optErr error
+			)
+			if err := rc.Control(func(fd uintptr) {
+				v, optErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR)
+			}); err != nil {
+				t.Fatalf("failed to control socket: %v", err)
+			}
+			if optErr != nil {
+				t.Fatalf("failed to get SO_REUSEADDR: %v", optErr)
+			}
+			if v != tt.want {
+				t.Errorf("expected SO_REUSEADDR to be %d, got %d", tt.want, v)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// setReuseAddr sets `SO_REUSEADDR` on the socket to the provided value.
+//
+// `SO_REUSEADDR` allows binding to an address that still has connections in `TIME_WAIT`, which
+// lets fiche rebind immediately after a restart. Unlike `SO_REUSEPORT`, it does not allow
+// multiple sockets to actively listen on the same address and port at the same time.
+func setReuseAddr(c syscall.RawConn, enabled bool) error {
+	v := 0
+	if enabled {
+		v = 1
+	}
+
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, v)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,11 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import "syscall"
+
+func setReuseAddr(_ syscall.RawConn, _ bool) error {
+	// On Windows `SO_REUSEADDR` allows other sockets to steal the address, so this is a no-op.
+	return nil
+}
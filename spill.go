@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+
+	"github.com/matthewpi/fiche/internal/sniff"
+)
+
+// spillBuffer buffers a paste in memory until it grows past a threshold, after which it is
+// moved to a temporary file on disk.
+//
+// Only the start of a spilled paste is kept in memory, enough for it to be sniffed.
+type spillBuffer struct {
+	ctx       context.Context
+	threshold int
+	dir       string
+
+	mem  bytes.Buffer
+	head []byte
+	file *os.File
+	size int
+}
+
+// newSpillBuffer returns a new buffer that spills to a temporary file in dir once it grows past
+// threshold bytes. A threshold of zero or less disables spilling.
+func newSpillBuffer(ctx context.Context, threshold int, dir string) *spillBuffer {
+	return &spillBuffer{ctx: ctx, threshold: threshold, dir: dir}
+}
+
+// Write satisfies the io.Writer interface.
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.threshold > 0 && b.mem.Len()+len(p) > b.threshold {
+		b.spill()
+	}
+	if b.file == nil {
+		b.size += len(p)
+		return b.mem.Write(p)
+	}
+	n, err := b.file.Write(p)
+	b.size += n
+	// The start of the paste may not have been in memory when it was spilled (e.g. the first
+	// write was already over the threshold).
+	if len(b.head) < sniff.MaxLength {
+		b.head = append(b.head, p[:min(n, sniff.MaxLength-len(b.head))]...)
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to write to spill file: %w", err)
+	}
+	return n, nil
+}
+
+// spill moves the buffered data to a temporary file.
+//
+// If the file can't be created (e.g. the temporary directory is missing or full), spilling is
+// disabled for this buffer and the paste continues to be buffered in memory.
+func (b *spillBuffer) spill() {
+	f, err := os.CreateTemp(b.dir, "fiche-*")
+	if err == nil {
+		_, err = f.Write(b.mem.Bytes())
+	}
+	if err != nil {
+		slog.LogAttrs(b.ctx, slog.LevelWarn, "failed to spill paste to disk, buffering in memory", slog.Any("err", err))
+		if f != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+		b.threshold = 0
+		return
+	}
+	b.file = f
+	b.head = bytes.Clone(b.mem.Bytes()[:min(b.mem.Len(), sniff.MaxLength)])
+	b.mem = bytes.Buffer{}
+}
+
+// Len returns the number of bytes written to the buffer.
+func (b *spillBuffer) Len() int {
+	return b.size
+}
+
+// Spilled returns true if the buffer has been moved to disk.
+func (b *spillBuffer) Spilled() bool {
+	return b.file != nil
+}
+
+// Bytes returns the buffered data if the buffer hasn't been spilled, or only the start of it
+// (at most sniff.MaxLength bytes) if it has.
+func (b *spillBuffer) Bytes() []byte {
+	if b.file != nil {
+		return b.head
+	}
+	return b.mem.Bytes()
+}
+
+// Reader returns a reader over all the data written to the buffer.
+func (b *spillBuffer) Reader() *io.SectionReader {
+	var r io.ReaderAt = bytes.NewReader(b.mem.Bytes())
+	if b.file != nil {
+		r = b.file
+	}
+	return io.NewSectionReader(r, 0, int64(b.size))
+}
+
+// Close removes the temporary file, if the buffer was spilled.
+func (b *spillBuffer) Close() error {
+	if b.file == nil {
+		return nil
+	}
+	return errors.Join(b.file.Close(), os.Remove(b.file.Name()))
+}
+
+// spillConflicts returns the flags that can't be used together with `--spill-to-disk`, as they
+// require the entire paste to be in memory.
+func spillConflicts() []string {
+	var conflicts []string
+	for flag, enabled := range map[string]bool{
+		"--allow-custom-keys":      CLI.AllowCustomKeys,
+		"--allow-filename":         CLI.AllowFilename,
+		"--accept-client-trace-id": CLI.AcceptClientTraceID,
+		"--strip-ansi":             CLI.StripANSI,
+		"--split-large":            CLI.SplitLarge,
+		"--batch-delimiter":        CLI.BatchDelimiter != "",
+		"--client-side-encrypt":    CLI.ClientSideEncrypt,
+		"--aggregate-file":         CLI.AggregateFile != "",
+		"--verify-upload":          CLI.VerifyUpload,
+	} {
+		if enabled {
+			conflicts = append(conflicts, flag)
+		}
+	}
+	slices.Sort(conflicts)
+	return conflicts
+}
@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/matthewpi/fiche/internal/sniff"
+)
+
+// tempFiles returns the names of the files in dir.
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestSpillBuffer(t *testing.T) {
+	dir := t.TempDir()
+	b := newSpillBuffer(context.Background(), 10, dir)
+
+	_, _ = b.Write([]byte("hello"))
+	if b.Spilled() {
+		t.Fatal("expected the buffer to not be spilled under the threshold")
+	}
+	_, _ = b.Write([]byte(" world!"))
+	if !b.Spilled() {
+		t.Fatal("expected the buffer to be spilled over the threshold")
+	}
+	if files := tempFiles(t, dir); len(files) != 1 || !strings.HasPrefix(files[0], "fiche-") {
+		t.Errorf("expected a temporary file, got %q", files)
+	}
+
+	if b.Len() != 12 {
+		t.Errorf("expected a length of 12, got %d", b.Len())
+	}
+	if string(b.Bytes()) != "hello world!" {
+		t.Errorf("expected the start of the paste to be kept in memory, got %q", b.Bytes())
+	}
+	data, err := io.ReadAll(b.Reader())
+	if err != nil {
+		t.Fatalf("failed to read buffer: %v", err)
+	}
+	if string(data) != "hello world!" {
+		t.Errorf("expected %q, got %q", "hello world!", data)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("failed to close buffer: %v", err)
+	}
+	if files := tempFiles(t, dir); len(files) > 0 {
+		t.Errorf("expected the temporary file to be removed, got %q", files)
+	}
+}
+
+func TestSpillBuffer_FirstWrite(t *testing.T) {
+	b := newSpillBuffer(context.Background(), 4, t.TempDir())
+	defer b.Close()
+
+	// The start of the paste is kept in memory, even if it was never buffered in memory.
+	paste := strings.Repeat("a", sniff.MaxLength*2)
+	_, _ = b.Write([]byte(paste))
+	if !b.Spilled() {
+		t.Fatal("expected the buffer to be spilled over the threshold")
+	}
+	if string(b.Bytes()) != paste[:sniff.MaxLength] {
+		t.Errorf("expected the first %d bytes to be kept in memory, got %d bytes", sniff.MaxLength, len(b.Bytes()))
+	}
+}
+
+func TestSpillBuffer_MissingDir(t *testing.T) {
+	b := newSpillBuffer(context.Background(), 4, filepath.Join(t.TempDir(), "missing"))
+	defer b.Close()
+
+	// Failing to spill falls back to buffering in memory.
+	_, _ = b.Write([]byte("hello world"))
+	if b.Spilled() {
+		t.Fatal("expected the buffer to not be spilled")
+	}
+	if string(b.Bytes()) != "hello world" {
+		t.Errorf("expected %q, got %q", "hello world", b.Bytes())
+	}
+}
+
+func TestHandle_SpillToDisk(t *testing.T) {
+	dir := t.TempDir()
+	setFlags(t, "--spill-to-disk=16", "--spill-dir="+dir)
+	paste := strings.Repeat("a", 1024)
+
+	h := &testHaste{}
+	var (
+		spilled       []string
+		contentLength int64
+	)
+	s, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		spilled, contentLength = tempFiles(t, dir), r.ContentLength
+		h.ServeHTTP(w, r)
+	}))
+
+	res, err := roundTrip(t, s, paste)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := s.haste.URL + "/doc1\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+	if len(spilled) != 1 {
+		t.Errorf("expected the paste to be spilled to disk while uploading, got %q", spilled)
+	}
+	if contentLength != int64(len(paste)) {
+		t.Errorf("expected a content length of %d, got %d", len(paste), contentLength)
+	}
+	if docs := h.documents(); !slices.Equal(docs, []string{paste}) {
+		t.Error("expected the spilled paste to be uploaded")
+	}
+	if files := tempFiles(t, dir); len(files) > 0 {
+		t.Errorf("expected the temporary file to be removed, got %q", files)
+	}
+}
+
+func TestSpillConflicts(t *testing.T) {
+	setFlags(t, "--verify-upload", "--allow-custom-keys")
+	if got, want := spillConflicts(), []string{"--allow-custom-keys", "--verify-upload"}; !slices.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
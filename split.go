@@ -0,0 +1,30 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import "bytes"
+
+// splitContent splits content into chunks of at most size bytes.
+//
+// Chunks are split on line boundaries where possible, a single line longer than size is split
+// at exactly size bytes.
+func splitContent(content []byte, size int) [][]byte {
+	if size < 1 || len(content) <= size {
+		return [][]byte{content}
+	}
+
+	chunks := make([][]byte, 0, len(content)/size+1)
+	for len(content) > size {
+		end := size
+		if i := bytes.LastIndexByte(content[:size], '\n'); i >= 0 {
+			end = i + 1
+		}
+		chunks = append(chunks, content[:end])
+		content = content[end:]
+	}
+	if len(content) > 0 {
+		chunks = append(chunks, content)
+	}
+	return chunks
+}
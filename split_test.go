@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func TestSplitContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		size    int
+		want    []string
+	}{
+		{
+			name:    "smaller than size",
+			content: "hello",
+			size:    10,
+			want:    []string{"hello"},
+		},
+		{
+			name:    "exactly size",
+			content: "0123456789",
+			size:    10,
+			want:    []string{"0123456789"},
+		},
+		{
+			name:    "long line",
+			content: "0123456789abcde",
+			size:    10,
+			want:    []string{"0123456789", "abcde"},
+		},
+		{
+			name:    "line boundaries",
+			content: "aaaaaa\nbbbbbb\ncccccc",
+			size:    10,
+			want:    []string{"aaaaaa\n", "bbbbbb\n", "cccccc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, chunk := range splitContent([]byte(tt.content), tt.size) {
+				got = append(got, string(chunk))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestHandle_SplitMaxDocuments(t *testing.T) {
+	setFlags(t, "--split-large", "--split-size=10", "--split-max-documents=2")
+	s, h := newTestServer(t, nil)
+
+	res, err := roundTrip(t, s, "aaaaaa\nbbbbbb\ncccccc")
+	if !errors.Is(err, ErrLimitExceeded) {
+		t.Errorf("expected ErrLimitExceeded, got %v", err)
+	}
+	if want := "Pastes may not be split into more than 2 documents\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+	if docs := h.documents(); len(docs) > 0 {
+		t.Errorf("expected no documents to be uploaded, got %q", docs)
+	}
+
+	res, err = roundTrip(t, s, "aaaaaa\nbbbbbb")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if docs := h.documents(); !slices.Equal(docs, []string{"aaaaaa\n", "bbbbbb"}) {
+		t.Errorf("expected 2 documents, got %q", docs)
+	}
+	if want := s.haste.URL + "/doc1\n" + s.haste.URL + "/doc2\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+}
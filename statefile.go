@@ -0,0 +1,28 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// writeStateFile writes a state file (e.g. a PID or ready file) to path, returning a function
+// that removes it again.
+//
+// State files are informational for init systems, failing to write or remove one is logged but
+// otherwise ignored. Removing a state file fails if privileges were dropped after writing it
+// and the unprivileged user can't write to its directory.
+func writeStateFile(ctx context.Context, path string, data []byte) func() {
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		slog.LogAttrs(ctx, slog.LevelWarn, "failed to write state file", slog.String("path", path), slog.Any("err", err))
+		return func() {}
+	}
+	return func() {
+		if err := os.Remove(path); err != nil {
+			slog.LogAttrs(ctx, slog.LevelWarn, "failed to remove state file", slog.String("path", path), slog.Any("err", err))
+		}
+	}
+}
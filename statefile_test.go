@@ -0,0 +1,35 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fiche.pid")
+	remove := writeStateFile(context.Background(), path, []byte("1234\n"))
+	if b, err := os.ReadFile(path); err != nil || string(b) != "1234\n" {
+		t.Errorf("expected the state file to contain %q, got %q (%v)", "1234\n", b, err)
+	}
+
+	remove()
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the state file to be removed, got %v", err)
+	}
+}
+
+func TestWriteStateFile_Error(t *testing.T) {
+	// Failing to write a state file is only logged.
+	path := filepath.Join(t.TempDir(), "missing", "fiche.pid")
+	writeStateFile(context.Background(), path, []byte("1234\n"))()
+	if _, err := os.Stat(path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected no state file to be written, got %v", err)
+	}
+}
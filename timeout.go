@@ -0,0 +1,60 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import "time"
+
+// adaptiveHalfRate is the throughput (in bytes per second) at which the adaptive timeout sits
+// halfway between its minimum and maximum.
+const adaptiveHalfRate = 4 * 1024
+
+// adaptiveMinElapsed is the minimum time (in seconds) a read is considered to have taken when
+// calculating throughput.
+const adaptiveMinElapsed = 0.1
+
+// adaptiveTimeout calculates read timeouts that scale with the throughput of a connection.
+//
+// Clients that have recently been sending data quickly are given more idle time between reads
+// (up to max), as they are likely on a slow link in the middle of a large paste. Clients that
+// trickle data in are given less (down to min), which limits the impact of slow-loris style
+// clients.
+type adaptiveTimeout struct {
+	min time.Duration
+	max time.Duration
+
+	// rate is an exponentially weighted moving average of the throughput in bytes per second.
+	rate float64
+	// last is the time of the last observed read.
+	last time.Time
+}
+
+// newAdaptiveTimeout returns a new adaptive timeout bounded by min and max.
+func newAdaptiveTimeout(minTimeout, maxTimeout time.Duration, now time.Time) *adaptiveTimeout {
+	return &adaptiveTimeout{
+		min:  minTimeout,
+		max:  max(minTimeout, maxTimeout),
+		last: now,
+	}
+}
+
+// observe records that n bytes were read at the provided time.
+func (a *adaptiveTimeout) observe(n int, now time.Time) {
+	elapsed := now.Sub(a.last).Seconds()
+	a.last = now
+	if elapsed < adaptiveMinElapsed {
+		// Don't let a burst of data arriving in quick succession (e.g. a single small paste)
+		// register as an enormous throughput.
+		elapsed = adaptiveMinElapsed
+	}
+
+	// Weigh the latest sample and the previous average equally, this allows the timeout to
+	// react quickly when a client speeds up or slows down.
+	a.rate = (a.rate + float64(n)/elapsed) / 2
+}
+
+// timeout returns the read timeout to use for the next read.
+func (a *adaptiveTimeout) timeout() time.Duration {
+	scale := a.rate / (a.rate + adaptiveHalfRate)
+	return a.min + time.Duration(scale*float64(a.max-a.min))
+}
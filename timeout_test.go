@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveTimeout(t *testing.T) {
+	const (
+		minTimeout = 1 * time.Second
+		maxTimeout = 10 * time.Second
+	)
+	now := time.Now()
+
+	a := newAdaptiveTimeout(minTimeout, maxTimeout, now)
+	if got := a.timeout(); got != minTimeout {
+		t.Errorf("expected the initial timeout to be %s, got %s", minTimeout, got)
+	}
+
+	// A client sending at the half rate sits halfway between the minimum and maximum.
+	a.rate = adaptiveHalfRate
+	if got, want := a.timeout(), minTimeout+(maxTimeout-minTimeout)/2; got != want {
+		t.Errorf("expected the timeout at the half rate to be %s, got %s", want, got)
+	}
+
+	// A fast client approaches the maximum.
+	a = newAdaptiveTimeout(minTimeout, maxTimeout, now)
+	for range 10 {
+		now = now.Add(time.Second)
+		a.observe(1024*1024, now)
+	}
+	fast := a.timeout()
+	if fast <= 9*time.Second || fast > maxTimeout {
+		t.Errorf("expected a fast client's timeout to approach %s, got %s", maxTimeout, fast)
+	}
+
+	// Slowing down reduces the timeout again.
+	for range 20 {
+		now = now.Add(time.Second)
+		a.observe(1, now)
+	}
+	if slow := a.timeout(); slow >= 2*time.Second {
+		t.Errorf("expected a slow client's timeout to approach %s, got %s", minTimeout, slow)
+	}
+}
+
+func TestAdaptiveTimeout_Burst(t *testing.T) {
+	now := time.Now()
+	a := newAdaptiveTimeout(time.Second, 10*time.Second, now)
+	// Data arriving all at once is treated as having taken adaptiveMinElapsed.
+	a.observe(100, now)
+	if want := float64(100) / adaptiveMinElapsed / 2; a.rate != want {
+		t.Errorf("expected a rate of %f, got %f", want, a.rate)
+	}
+}
+
+func TestNewAdaptiveTimeout_MaxBelowMin(t *testing.T) {
+	a := newAdaptiveTimeout(5*time.Second, time.Second, time.Now())
+	a.rate = 1024 * 1024
+	if got := a.timeout(); got != 5*time.Second {
+		t.Errorf("expected the timeout to be clamped to the minimum, got %s", got)
+	}
+}
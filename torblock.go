@@ -0,0 +1,136 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxExitListSize is the maximum size of an exit node list that will be loaded.
+const maxExitListSize = 16 * 1024 * 1024
+
+// Actions taken for connections from Tor exit nodes when using `--tor-block`.
+const (
+	torBlockReject = "reject"
+	torBlockLog    = "log"
+)
+
+// exitList is a periodically refreshed list of Tor exit node addresses.
+type exitList struct {
+	// source is the path or http(s) URL the list is loaded from.
+	source string
+
+	mu    sync.RWMutex
+	addrs map[netip.Addr]struct{}
+}
+
+// newExitList returns a new, empty exit node list loaded from source.
+func newExitList(source string) *exitList {
+	return &exitList{source: source}
+}
+
+// Contains returns true if addr is a known exit node.
+func (l *exitList) Contains(addr netip.Addr) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	_, ok := l.addrs[addr.Unmap()]
+	return ok
+}
+
+// Load (re)loads the list from its source, replacing the current list if successful.
+func (l *exitList) Load(ctx context.Context) error {
+	b, err := l.read(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read tor exit list: %w", err)
+	}
+	addrs := parseExitList(b)
+
+	l.mu.Lock()
+	l.addrs = addrs
+	l.mu.Unlock()
+	return nil
+}
+
+// read reads the contents of the list's source.
+func (l *exitList) read(ctx context.Context) ([]byte, error) {
+	if !strings.HasPrefix(l.source, "http://") && !strings.HasPrefix(l.source, "https://") {
+		f, err := os.Open(l.source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(io.LimitReader(f, maxExitListSize))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, l.source, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http request: %w", err)
+	}
+	req.Header.Set("User-Agent", "github.com/matthewpi/fiche")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute http request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", res.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, maxExitListSize))
+}
+
+// Refresh reloads the list every interval until ctx is canceled. If a reload fails, the previous
+// list continues to be used.
+func (l *exitList) Refresh(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Load(ctx); err != nil {
+				slog.LogAttrs(ctx, slog.LevelWarn, "failed to refresh tor exit list", slog.Any("err", err))
+			}
+		}
+	}
+}
+
+// parseExitList parses a list of exit node addresses.
+//
+// Both a plain list of addresses (one per line) and the `exit-addresses` format published by the
+// Tor Project (`ExitAddress <addr> <date> <time>` lines) are supported. Blank lines, comments and
+// unrecognized lines are ignored.
+func parseExitList(b []byte) map[netip.Addr]struct{} {
+	addrs := make(map[netip.Addr]struct{})
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 1 {
+			continue
+		}
+		field := fields[0]
+		if field == "ExitAddress" && len(fields) > 1 {
+			field = fields[1]
+		}
+		addr, err := netip.ParseAddr(field)
+		if err != nil {
+			continue
+		}
+		addrs[addr.Unmap()] = struct{}{}
+	}
+	return addrs
+}
@@ -0,0 +1,155 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testExitList is a static exit node list, using both supported formats.
+const testExitList = `# exit nodes
+192.0.2.1
+2001:db8::1
+
+ExitNode 0011BD2485AD45D984EC4159C88FC066E5E3300E
+Published 2024-01-01 00:00:00
+ExitAddress 198.51.100.7 2024-01-01 00:00:00
+not an address
+`
+
+func TestExitList(t *testing.T) {
+	tests := []struct {
+		name   string
+		source func(t *testing.T) string
+	}{
+		{
+			name: "file",
+			source: func(t *testing.T) string {
+				path := filepath.Join(t.TempDir(), "exit-addresses")
+				if err := os.WriteFile(path, []byte(testExitList), 0o600); err != nil {
+					t.Fatalf("failed to write exit list: %v", err)
+				}
+				return path
+			},
+		},
+		{
+			name: "url",
+			source: func(t *testing.T) string {
+				srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					_, _ = w.Write([]byte(testExitList))
+				}))
+				t.Cleanup(srv.Close)
+				return srv.URL
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newExitList(tt.source(t))
+			if err := l.Load(context.Background()); err != nil {
+				t.Fatalf("failed to load exit list: %v", err)
+			}
+			for addr, want := range map[string]bool{
+				"192.0.2.1":          true,
+				"::ffff:192.0.2.1":   true,
+				"2001:db8::1":        true,
+				"198.51.100.7":       true,
+				"192.0.2.2":          false,
+				"2001:db8::2":        false,
+				"203.0.113.1":        false,
+				"::ffff:203.0.113.1": false,
+			} {
+				if got := l.Contains(netip.MustParseAddr(addr)); got != want {
+					t.Errorf("expected %t for %s, got %t", want, addr, got)
+				}
+			}
+		})
+	}
+}
+
+func TestExitList_FailedReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "exit-addresses")
+	if err := os.WriteFile(path, []byte("192.0.2.1\n"), 0o600); err != nil {
+		t.Fatalf("failed to write exit list: %v", err)
+	}
+	l := newExitList(path)
+	if err := l.Load(context.Background()); err != nil {
+		t.Fatalf("failed to load exit list: %v", err)
+	}
+
+	// The previous list keeps being used if a reload fails.
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("failed to remove exit list: %v", err)
+	}
+	if err := l.Load(context.Background()); err == nil {
+		t.Error("expected an error loading a missing exit list")
+	}
+	if !l.Contains(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("expected the previous list to still be used")
+	}
+}
+
+func TestHandle_TorBlock(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		list   string
+		reject bool
+	}{
+		{
+			name:   "exit node",
+			list:   "127.0.0.1\n",
+			reject: true,
+		},
+		{
+			name: "not an exit node",
+			list: "192.0.2.1\n",
+		},
+		{
+			name: "log",
+			args: []string{"--tor-block-action=log"},
+			list: "127.0.0.1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlags(t, tt.args...)
+			s, h := newTestServer(t, nil)
+			s.tor = &exitList{addrs: parseExitList([]byte(tt.list))}
+
+			// The connection may be rejected before the data is sent.
+			res, err := roundTripFunc(t, s, func(conn *net.TCPConn) error {
+				_, _ = conn.Write([]byte("hello"))
+				_ = conn.CloseWrite()
+				return nil
+			})
+			if !tt.reject {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if want := s.haste.URL + "/doc1\n"; res != want {
+					t.Errorf("expected response %q, got %q", want, res)
+				}
+				return
+			}
+			if !errors.Is(err, ErrRejected) {
+				t.Errorf("expected ErrRejected, got %v", err)
+			}
+			if want := "Connections from Tor exit nodes are not allowed\n"; res != want {
+				t.Errorf("expected response %q, got %q", want, res)
+			}
+			if docs := h.documents(); len(docs) > 0 {
+				t.Errorf("expected no documents, got %q", docs)
+			}
+		})
+	}
+}
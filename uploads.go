@@ -0,0 +1,53 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// uploadLimiter limits the number of concurrent uploads to the haste-server per address.
+//
+// This complements `--upstream-max-concurrent`, preventing a single client from using up all of
+// the available upload slots.
+type uploadLimiter struct {
+	max int
+
+	mu       sync.Mutex
+	inflight map[netip.Addr]int
+}
+
+// newUploadLimiter returns a new limiter allowing up to max concurrent uploads per address.
+func newUploadLimiter(max int) *uploadLimiter {
+	return &uploadLimiter{
+		max:      max,
+		inflight: make(map[netip.Addr]int),
+	}
+}
+
+// Acquire reserves an upload slot for addr, returning false if addr already has the maximum
+// number of uploads in-flight. Release must be called once the upload has finished if Acquire
+// returned true.
+func (l *uploadLimiter) Acquire(addr netip.Addr) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.inflight[addr] >= l.max {
+		return false
+	}
+	l.inflight[addr]++
+	return true
+}
+
+// Release releases an upload slot for addr.
+func (l *uploadLimiter) Release(addr netip.Addr) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Remove the entry entirely, so addresses without any in-flight uploads aren't tracked.
+	if l.inflight[addr] <= 1 {
+		delete(l.inflight, addr)
+		return
+	}
+	l.inflight[addr]--
+}
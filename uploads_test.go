@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func TestUploadLimiter(t *testing.T) {
+	l := newUploadLimiter(2)
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+
+	for i := range 2 {
+		if !l.Acquire(a) {
+			t.Fatalf("expected upload %d to be allowed", i+1)
+		}
+	}
+	if l.Acquire(a) {
+		t.Error("expected the upload to be rejected over the limit")
+	}
+	if !l.Acquire(b) {
+		t.Error("expected other addresses to be limited separately")
+	}
+
+	l.Release(a)
+	if !l.Acquire(a) {
+		t.Error("expected the upload to be allowed after a slot was released")
+	}
+
+	l.Release(a)
+	l.Release(a)
+	l.Release(b)
+	if n := len(l.inflight); n > 0 {
+		t.Errorf("expected addresses without in-flight uploads to not be tracked, got %d", n)
+	}
+}
+
+func TestHandle_MaxUploadsPerIP(t *testing.T) {
+	setFlags(t, "--max-uploads-per-ip=1")
+	uploading, unblock := make(chan struct{}), make(chan struct{})
+	h := &testHaste{}
+	s, _ := newTestServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Block the first upload until the second has been handled.
+		if len(h.documents()) == 0 {
+			close(uploading)
+			<-unblock
+		}
+		h.ServeHTTP(w, r)
+	}))
+	s.uploads = newUploadLimiter(CLI.MaxUploadsPerIP)
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := roundTrip(t, s, "first")
+		first <- err
+	}()
+	<-uploading
+
+	res, err := roundTripFunc(t, s, func(conn *net.TCPConn) error {
+		_, _ = conn.Write([]byte("second"))
+		_ = conn.CloseWrite()
+		return nil
+	})
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("expected ErrRejected, got %v", err)
+	}
+	if want := "Too many uploads in progress from your address, please try again later\n"; res != want {
+		t.Errorf("expected response %q, got %q", want, res)
+	}
+
+	close(unblock)
+	if err := <-first; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// The slot is released once the upload has finished.
+	if _, err := roundTrip(t, s, "third"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if docs := h.documents(); len(docs) != 2 {
+		t.Errorf("expected 2 documents, got %q", docs)
+	}
+}
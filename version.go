@@ -0,0 +1,22 @@
+// SPDX-License-Identifier: MIT
+// SPDX-FileCopyrightText: Copyright (c) 2024 Matthew Penner
+
+package main
+
+import "runtime/debug"
+
+// version is the version of fiche, it may be set at build time using
+// `-ldflags "-X main.version=<version>"`.
+var version string
+
+// getVersion returns the version of fiche, falling back to the module version from the build
+// info if it wasn't set at build time.
+func getVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}